@@ -1,16 +1,12 @@
 package auth
 
 import (
-	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/antonybholmes/go-sys"
 	"github.com/google/uuid"
 	gonanoid "github.com/matoous/go-nanoid/v2"
 	"github.com/xyproto/randomstring"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -75,6 +71,14 @@ type AuthUser struct {
 	UpdatedAt       time.Duration `json:"-"`
 	EmailVerifiedAt time.Duration `json:"-"`
 	IsLocked        bool          `json:"isLocked"`
+	// true once the user has a confirmed second factor
+	MfaEnabled bool `json:"mfaEnabled"`
+	// unused mfa recovery codes left
+	RecoveryCodes uint `json:"recoveryCodes"`
+	// when a temporary lockout after too many failed sign ins ends,
+	// in seconds since the epoch, or 0 if the user is not locked out.
+	// Unlike IsLocked this is set automatically, see LoginThrottle.
+	UnlockAt int64 `json:"unlockAt"`
 }
 
 // The admin view adds roles to each user as it is assumed this
@@ -120,7 +124,7 @@ func init() {
 // 		UpdatedAt: updated}
 // }
 
-func (user *AuthUser) CheckPasswordsMatch(plainPwd string) error {
+func (user *AuthUser) CheckPasswordsMatch(plainPwd string) (bool, error) {
 	return CheckPasswordsMatch(user.HashedPassword, plainPwd)
 }
 
@@ -156,40 +160,22 @@ func CanSignin(roles string) bool {
 // 	return randomstring.CookieFriendlyString(32)
 // }
 
-func HashPassword(password string) string {
-	return string(sys.Must(bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)))
+// Hash a password with the current PasswordHasher
+func HashPassword(password string) (string, error) {
+	return passwordHasher.Hash(NormalizePassword(password))
 }
 
-func CheckPasswordsMatch(hashedPassword string, plainPwd string) error {
-
-	// Since we'll be getting the hashed password from the DB it
-	// will be a string so we'll need to convert it to a byte slice
-
-	//log.Printf("comp %s %s\n", string(user.HashedPassword), string(plainPwd))
-
-	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(plainPwd))
-
-	if err != nil {
-		return fmt.Errorf("passwords do not match")
-	}
-
-	return nil
-}
-
-// Only to be used for database update events.
-func CreateOTP(user *AuthUser) string {
-	return HashPassword(strconv.FormatInt(user.UpdatedAt.Nanoseconds(), 10))
-
-}
-
-func CheckOTPValid(user *AuthUser, otp string) error {
-	err := CheckPasswordsMatch(otp, strconv.FormatInt(user.UpdatedAt.Nanoseconds(), 10))
+// Check a password against its hash. If it matches, also returns
+// true if the hash was made with an older hasher or settings and
+// should be replaced with a new hash of the password.
+func CheckPasswordsMatch(hashedPassword string, plainPwd string) (bool, error) {
+	err := verifyPassword(hashedPassword, NormalizePassword(plainPwd))
 
 	if err != nil {
-		return fmt.Errorf("one time code has expired")
+		return false, err
 	}
 
-	return nil
+	return passwordHasher.NeedsRehash(hashedPassword), nil
 }
 
 func NanoId() string {
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// Checks passwords against a local copy of the Have I Been Pwned
+// password list, for servers that cannot call the api. The file is
+// the sorted list of sha1 hashes the HIBP downloader makes, one
+// HASH:COUNT line per password, e.g.
+//
+//	000000005AD76BD555C1D6D771DE417A4B87E4B4:10
+//
+// The file is memory mapped, so only the pages a lookup touches are
+// read and the os can share them between processes.
+type BreachedPasswords struct {
+	data  []byte
+	close func() error
+}
+
+func OpenBreachedPasswords(file string) (*BreachedPasswords, error) {
+	data, close, err := mapFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &BreachedPasswords{data: data, close: close}, nil
+}
+
+func (bp *BreachedPasswords) Close() error {
+	bp.data = nil
+	return bp.close()
+}
+
+// How many times the password appears in breaches, 0 if it does not
+func (bp *BreachedPasswords) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(NormalizePassword(password)))
+	target := bytes.ToUpper([]byte(hex.EncodeToString(sum[:])))
+
+	data := bp.data
+
+	// lo and hi are always at the start of a line
+	lo := 0
+	hi := len(data)
+
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start := lo + bytes.LastIndexByte(data[lo:mid], '\n') + 1
+		end := bytes.IndexByte(data[start:], '\n')
+
+		if end == -1 {
+			end = len(data)
+		} else {
+			end += start
+		}
+
+		line := bytes.TrimRight(data[start:end], "\r")
+
+		if len(line) < len(target) {
+			return 0, fmt.Errorf("breached password file has an invalid line at %d", start)
+		}
+
+		switch bytes.Compare(line[:len(target)], target) {
+		case 0:
+			count, err := strconv.Atoi(string(bytes.TrimPrefix(line[len(target):], []byte(":"))))
+
+			if err != nil {
+				return 0, fmt.Errorf("breached password file has an invalid count at %d", start)
+			}
+
+			return count, nil
+		case -1:
+			lo = end + 1
+		default:
+			hi = start
+		}
+	}
+
+	return 0, nil
+}
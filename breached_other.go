@@ -0,0 +1,16 @@
+//go:build !unix
+
+package auth
+
+import "os"
+
+// no mmap so read the whole file
+func mapFile(file string) ([]byte, func() error, error) {
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error { return nil }, nil
+}
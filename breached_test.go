@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The passwords in testdata/breached.txt, which is sorted by hash so
+// football is the first record and iloveyou the last
+var breachedFixture = map[string]int{
+	"football": 21,
+	"password": 9659365,
+	"abc123":   4,
+	"123456":   42,
+	"sunshine": 8,
+	"baseball": 17,
+	"monkey":   5,
+	"dragon":   7,
+	"qwerty":   3,
+	"letmein":  11,
+	"trustno1": 2,
+	"iloveyou": 13,
+}
+
+// Write data to a temp file and open it
+func openTestBreached(t *testing.T, data []byte) *BreachedPasswords {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "breached.txt")
+
+	err := os.WriteFile(file, data, 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bp, err := OpenBreachedPasswords(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { bp.Close() })
+
+	return bp
+}
+
+func testBreachedCounts(t *testing.T, bp *BreachedPasswords) {
+	t.Helper()
+
+	for password, want := range breachedFixture {
+		count, err := bp.Count(password)
+
+		if err != nil {
+			t.Fatalf("%s: %s", password, err)
+		}
+
+		if count != want {
+			t.Errorf("%s: got %d, want %d", password, count, want)
+		}
+	}
+
+	for _, password := range []string{"", "password123", "correct horse battery staple", "Password"} {
+		count, err := bp.Count(password)
+
+		if err != nil || count != 0 {
+			t.Errorf("%q: got %d, %v", password, count, err)
+		}
+	}
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	bp, err := OpenBreachedPasswords("testdata/breached.txt")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bp.Close()
+
+	testBreachedCounts(t, bp)
+
+	// passwords are normalized before hashing
+	count, err := bp.Count("ｐａｓｓｗｏｒｄ")
+
+	if err != nil || count != breachedFixture["password"] {
+		t.Fatalf("full width password: got %d, %v", count, err)
+	}
+}
+
+func TestBreachedPasswordsLineEndings(t *testing.T) {
+	data, err := os.ReadFile("testdata/breached.txt")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("crlf", func(t *testing.T) {
+		testBreachedCounts(t, openTestBreached(t, bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))))
+	})
+
+	t.Run("no trailing newline", func(t *testing.T) {
+		testBreachedCounts(t, openTestBreached(t, bytes.TrimSuffix(data, []byte("\n"))))
+	})
+}
+
+func TestBreachedPasswordsSmallFiles(t *testing.T) {
+	bp := openTestBreached(t, nil)
+
+	count, err := bp.Count("password")
+
+	if err != nil || count != 0 {
+		t.Fatalf("empty file: got %d, %v", count, err)
+	}
+
+	bp = openTestBreached(t, []byte("5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:10\n"))
+
+	for password, want := range map[string]int{"password": 10, "football": 0, "iloveyou": 0} {
+		count, err := bp.Count(password)
+
+		if err != nil || count != want {
+			t.Errorf("one line file, %s: got %d, %v", password, count, err)
+		}
+	}
+}
+
+func TestBreachedPasswordsTruncated(t *testing.T) {
+	data, err := os.ReadFile("testdata/breached.txt")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cut into the last hash, and just before its count
+	last := bytes.LastIndexByte(data[:len(data)-1], '\n') + 1
+
+	tests := map[string][]byte{
+		"hash":  data[:last+20],
+		"count": data[:last+41],
+	}
+
+	for name, truncated := range tests {
+		bp := openTestBreached(t, truncated)
+
+		_, err := bp.Count("iloveyou")
+
+		if err == nil {
+			t.Errorf("truncated %s: expected an error", name)
+		}
+
+		// lookups that never reach the broken line still work
+		count, err := bp.Count("football")
+
+		if err != nil || count != breachedFixture["football"] {
+			t.Errorf("truncated %s: got %d, %v", name, count, err)
+		}
+	}
+
+	_, err = OpenBreachedPasswords(filepath.Join(t.TempDir(), "missing.txt"))
+
+	if err == nil {
+		t.Fatal("opened a missing file")
+	}
+}
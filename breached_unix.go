@@ -0,0 +1,37 @@
+//go:build unix
+
+package auth
+
+import (
+	"os"
+	"syscall"
+)
+
+func mapFile(file string) ([]byte, func() error, error) {
+	f, err := os.Open(file)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the mapping stays valid after the file is closed
+	defer f.Close()
+
+	info, err := f.Stat()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if info.Size() == 0 {
+		return nil, func() error { return nil }, nil
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
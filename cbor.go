@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Just enough CBOR (RFC 8949) to read webauthn attestation objects
+// and COSE keys. Authenticators use the CTAP2 canonical form so
+// indefinite lengths are not supported. Maps decode to map[any]any
+// with int64 or string keys.
+
+const CBOR_MAX_DEPTH = 16
+
+// Decode one value from data and return it with the bytes after it
+func decodeCbor(data []byte) (any, []byte, error) {
+	return decodeCborValue(data, 0)
+}
+
+func decodeCborValue(data []byte, depth int) (any, []byte, error) {
+	if depth > CBOR_MAX_DEPTH {
+		return nil, nil, fmt.Errorf("cbor is nested too deeply")
+	}
+
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("cbor is truncated")
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+
+	// simple values. Floats are not used by webauthn.
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data[1:], nil
+		case 21:
+			return true, data[1:], nil
+		case 22, 23:
+			return nil, data[1:], nil
+		default:
+			return nil, nil, fmt.Errorf("unsupported cbor simple value %d", info)
+		}
+	}
+
+	n, data, err := cborArgument(info, data[1:])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("cbor integer is too large")
+		}
+
+		return int64(n), data, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("cbor integer is too large")
+		}
+
+		return -1 - int64(n), data, nil
+	case 2, 3:
+		if n > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("cbor is truncated")
+		}
+
+		if major == 2 {
+			return data[:n], data[n:], nil
+		}
+
+		return string(data[:n]), data[n:], nil
+	case 4:
+		// each item is at least one byte
+		if n > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("cbor is truncated")
+		}
+
+		items := make([]any, 0, n)
+
+		for range n {
+			var item any
+
+			item, data, err = decodeCborValue(data, depth+1)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			items = append(items, item)
+		}
+
+		return items, data, nil
+	case 5:
+		if n > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("cbor is truncated")
+		}
+
+		items := make(map[any]any, n)
+
+		for range n {
+			var key any
+			var value any
+
+			key, data, err = decodeCborValue(data, depth+1)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("unsupported cbor map key %T", key)
+			}
+
+			value, data, err = decodeCborValue(data, depth+1)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			items[key] = value
+		}
+
+		return items, data, nil
+	default:
+		// tags, which we do not need, so return the tagged value
+		return decodeCborValue(data, depth+1)
+	}
+}
+
+// The length or value that follows the initial byte
+func cborArgument(info byte, data []byte) (uint64, []byte, error) {
+	size := 0
+
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, nil, fmt.Errorf("unsupported cbor length %d", info)
+	}
+
+	if len(data) < size {
+		return 0, nil, fmt.Errorf("cbor is truncated")
+	}
+
+	var n uint64
+
+	for _, b := range data[:size] {
+		n = n<<8 | uint64(b)
+	}
+
+	return n, data[size:], nil
+}
+
+// COSE (RFC 9053) key and algorithm ids
+const (
+	COSE_KTY_OKP = 1
+	COSE_KTY_EC2 = 2
+	COSE_KTY_RSA = 3
+
+	COSE_ALG_ES256 = -7
+	COSE_ALG_EDDSA = -8
+	COSE_ALG_RS256 = -257
+
+	COSE_CRV_P256    = 1
+	COSE_CRV_ED25519 = 6
+)
+
+// The public key in a COSE_Key map and the algorithm name it is
+// used with, one of RS256, ES256 or EdDSA
+func parseCoseKey(data []byte) (crypto.PublicKey, string, error) {
+	value, _, err := decodeCbor(data)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	key, ok := value.(map[any]any)
+
+	if !ok {
+		return nil, "", fmt.Errorf("cose key is not a map")
+	}
+
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch {
+	case kty == COSE_KTY_EC2 && alg == COSE_ALG_ES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+
+		if crv != COSE_CRV_P256 || len(x) != 32 || len(y) != 32 {
+			return nil, "", fmt.Errorf("invalid P-256 cose key")
+		}
+
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(),
+			X: new(big.Int).SetBytes(x),
+			Y: new(big.Int).SetBytes(y)}
+
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, "", fmt.Errorf("cose key is not on the curve")
+		}
+
+		return publicKey, ES256, nil
+	case kty == COSE_KTY_OKP && alg == COSE_ALG_EDDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+
+		if crv != COSE_CRV_ED25519 || len(x) != ed25519.PublicKeySize {
+			return nil, "", fmt.Errorf("invalid ed25519 cose key")
+		}
+
+		return ed25519.PublicKey(x), EDDSA, nil
+	case kty == COSE_KTY_RSA && alg == COSE_ALG_RS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, "", fmt.Errorf("invalid rsa cose key")
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, RS256, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported cose key type %d with algorithm %d", kty, alg)
+	}
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// RFC 8949 appendix A
+func TestDecodeCbor(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want any
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6161", "a"},
+		{"6449455446", "IETF"},
+		{"80", []any{}},
+		{"83010203", []any{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}},
+		{"a0", map[any]any{}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+		// tags are skipped
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+	}
+
+	for _, test := range tests {
+		value, rest, err := decodeCbor(mustHex(t, test.hex))
+
+		if err != nil {
+			t.Errorf("%s: %s", test.hex, err)
+			continue
+		}
+
+		if len(rest) != 0 {
+			t.Errorf("%s: %d bytes left over", test.hex, len(rest))
+		}
+
+		if !reflect.DeepEqual(value, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.hex, value, test.want)
+		}
+	}
+}
+
+func TestDecodeCborReturnsRest(t *testing.T) {
+	value, rest, err := decodeCbor(mustHex(t, "0102"))
+
+	if err != nil || value != int64(1) || !bytes.Equal(rest, []byte{2}) {
+		t.Fatalf("got %v %v %v", value, rest, err)
+	}
+}
+
+func TestDecodeCborInvalid(t *testing.T) {
+	tests := map[string]string{
+		"empty":                     "",
+		"truncated length":          "19e8",
+		"truncated bytes":           "44010203",
+		"truncated text":            "64494554",
+		"truncated array":           "830102",
+		"truncated map":             "a2010203",
+		"byte length past end":      "5affffffff00",
+		"array length past end":     "9b7fffffffffffffff00",
+		"map length past end":       "bb7fffffffffffffff00",
+		"integer too large":         "1bffffffffffffffff",
+		"negative integer too big":  "3bffffffffffffffff",
+		"indefinite length":         "5f4101ff",
+		"reserved length":           "1c",
+		"float":                     "f93c00",
+		"array map key":             "a18000",
+		"nested too deeply":         strings.Repeat("81", CBOR_MAX_DEPTH+2) + "00",
+		"tags nested too deeply":    strings.Repeat("c0", CBOR_MAX_DEPTH+2) + "00",
+		"truncated attestation key": "a363666d74646e6f6e6567617474537461",
+	}
+
+	for name, s := range tests {
+		_, _, err := decodeCbor(mustHex(t, s))
+
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// The P-256 example in the WebAuthn spec, section 6.5.1.1
+const COSE_ES256_KEY_HEX = "a5 01 02 03 26 20 01" +
+	" 21 58 20 65eda5a12577c2bae829437fe338701a10aaa375e1bb5b5de108de439c08551d" +
+	" 22 58 20 1e52ed75701163f7f9e40ddf9f341b3dc9ba860af7e0ca7ca7e9eecd0084d19c"
+
+// The RFC 8032 test 1 public key as an OKP key
+const COSE_EDDSA_KEY_HEX = "a4 01 01 03 27 20 06" +
+	" 21 58 20 d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+
+func TestParseCoseKey(t *testing.T) {
+	publicKey, alg, err := parseCoseKey(mustHex(t, COSE_ES256_KEY_HEX))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, ok := publicKey.(*ecdsa.PublicKey)
+
+	if alg != ES256 || !ok || hex.EncodeToString(ecKey.X.Bytes()) != "65eda5a12577c2bae829437fe338701a10aaa375e1bb5b5de108de439c08551d" {
+		t.Fatalf("got %s %T", alg, publicKey)
+	}
+
+	publicKey, alg, err = parseCoseKey(mustHex(t, COSE_EDDSA_KEY_HEX))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edKey, ok := publicKey.(ed25519.PublicKey)
+
+	if alg != EDDSA || !ok || hex.EncodeToString(edKey) != "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a" {
+		t.Fatalf("got %s %T", alg, publicKey)
+	}
+}
+
+func TestParseCoseKeyInvalid(t *testing.T) {
+	tests := map[string]string{
+		"not a map":    "80",
+		"truncated":    COSE_ES256_KEY_HEX[:40],
+		"wrong curve":  strings.Replace(COSE_ES256_KEY_HEX, "20 01", "20 02", 1),
+		"off curve":    strings.Replace(COSE_ES256_KEY_HEX, "65eda5", "65eda6", 1),
+		"short x":      "a5 01 02 03 26 20 01 21 41 00 22 41 00",
+		"wrong alg":    strings.Replace(COSE_ES256_KEY_HEX, "03 26", "03 27", 1),
+		"ed wrong crv": strings.Replace(COSE_EDDSA_KEY_HEX, "20 06", "20 04", 1),
+		"short rsa":    "a4 01 03 03 39 0100 20 41 01 21 43 010001",
+	}
+
+	for name, s := range tests {
+		_, _, err := parseCoseKey(mustHex(t, s))
+
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrTokenAlreadyUsed = errors.New("token has already been used")
+
+// Ledger of one time tokens that have been redeemed, so links such
+// as password resets and passwordless sign ins only work once. Like
+// revocations, entries can be pruned once the token has expired.
+type ConsumedTokenStore interface {
+	// Record a token as used. Returns false if it was already
+	// used so only one of several concurrent redemptions wins.
+	ConsumeToken(ctx context.Context, id string, tokenType TokenType, expiresAt int64) (bool, error)
+	// Delete entries for tokens that expired before now
+	DeleteExpiredConsumedTokens(ctx context.Context, now int64) error
+}
+
+const INSERT_CONSUMED_TOKEN_SQL = `INSERT IGNORE INTO consumed_tokens (id, token_type, expires_at, consumed_at) VALUES (?, ?, ?, ?)`
+
+const DELETE_EXPIRED_CONSUMED_TOKENS_SQL = `DELETE FROM consumed_tokens WHERE expires_at < ?`
+
+func (userdb *UserDb) ConsumeToken(ctx context.Context, id string, tokenType TokenType, expiresAt int64) (bool, error) {
+	now := time.Now().Unix()
+
+	result, err := userdb.exec(ctx, INSERT_CONSUMED_TOKEN_SQL, id, tokenType, expiresAt, now)
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	if n == 0 {
+		return false, nil
+	}
+
+	err = userdb.DeleteExpiredConsumedTokens(ctx, now)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (userdb *UserDb) DeleteExpiredConsumedTokens(ctx context.Context, now int64) error {
+	_, err := userdb.exec(ctx, DELETE_EXPIRED_CONSUMED_TOKENS_SQL, now)
+
+	return err
+}
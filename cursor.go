@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// used by every listing when 0 records are asked for
+const DEFAULT_PAGE_RECORDS uint = 100
+
+// the most records a listing returns however many are asked for so
+// one request cannot load a whole table
+const MAX_PAGE_RECORDS uint = 1000
+
+const (
+	ROLES_CURSOR    = "roles"
+	API_KEYS_CURSOR = "api_keys"
+)
+
+// One page of a listing. NextCursor is empty on the last page,
+// otherwise pass it back to get the following page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// Cursors record the sort values of the last item on a page so the
+// next page can carry on from it (keyset pagination). The kind stops
+// a cursor from one listing, or sort order, being used with another.
+type pageCursor struct {
+	Kind   string `json:"k"`
+	Values []any  `json:"v"`
+}
+
+func encodeCursor(kind string, values []any) (string, error) {
+	data, err := json.Marshal(pageCursor{Kind: kind, Values: values})
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Decode a cursor into its sort values. Numbers are returned as
+// int64 and everything else as strings. An empty cursor means the
+// first page and returns no values.
+func decodeCursor(kind string, cursor string) ([]any, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var c pageCursor
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	err = decoder.Decode(&c)
+
+	if err != nil || c.Kind != kind {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	for vi, v := range c.Values {
+		switch v := v.(type) {
+		case json.Number:
+			n, err := v.Int64()
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid cursor")
+			}
+
+			c.Values[vi] = n
+		case string:
+		default:
+			return nil, fmt.Errorf("invalid cursor")
+		}
+	}
+
+	return c.Values, nil
+}
+
+// Condition selecting rows after the cursor when sorted by columns,
+// e.g. (roles.name, roles.id) > (?, ?)
+func keysetClause(columns []string, desc bool) string {
+	op := ">"
+
+	if desc {
+		op = "<"
+	}
+
+	params := inParams(len(columns))
+
+	return fmt.Sprintf("(%s) %s (%s)", strings.Join(columns, ", "), op, params)
+}
+
+// Compare sort values in the same way as the sql row comparison
+// in keysetClause, for stores that page in memory
+func compareSortValues(a []any, b []any) int {
+	for i := range min(len(a), len(b)) {
+		var c int
+
+		switch av := a[i].(type) {
+		case int64:
+			bv, _ := b[i].(int64)
+			c = cmp.Compare(av, bv)
+		case string:
+			bv, _ := b[i].(string)
+			c = strings.Compare(av, bv)
+		}
+
+		if c != 0 {
+			return c
+		}
+	}
+
+	return cmp.Compare(len(a), len(b))
+}
+
+// True if values sort after the cursor, or there is no cursor
+func isAfterCursor(values []any, after []any, desc bool) bool {
+	if after == nil {
+		return true
+	}
+
+	c := compareSortValues(values, after)
+
+	if desc {
+		return c < 0
+	}
+
+	return c > 0
+}
+
+// Trim a page fetched with one extra row to the requested size and
+// make the cursor for the next page from the last row returned
+func makePage[T any](kind string, items []T, records uint, sortValues func(item T) []any) (*Page[T], error) {
+	page := Page[T]{Items: items}
+
+	if uint(len(items)) <= records {
+		return &page, nil
+	}
+
+	page.Items = items[:records]
+
+	cursor, err := encodeCursor(kind, sortValues(page.Items[records-1]))
+
+	if err != nil {
+		return nil, err
+	}
+
+	page.NextCursor = cursor
+
+	return &page, nil
+}
+
+func roleSortValues(role *Role) []any {
+	return []any{role.Name, int64(role.Id)}
+}
+
+func apiKeySortValues(key string) []any {
+	return []any{key}
+}
+
+// How many records a listing returns when asked for records
+func pageRecords(records uint) uint {
+	if records == 0 {
+		return DEFAULT_PAGE_RECORDS
+	}
+
+	return min(records, MAX_PAGE_RECORDS)
+}
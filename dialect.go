@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The sql in this package is written for MySQL. A dialect
+// describes how to translate it for other database backends.
+type SqlDialect struct {
+	Name   string
+	driver string
+	// replacement for SELECT_USERS_SQL so that dates are
+	// returned as seconds since year 0 like TO_SECONDS
+	selectUsersSql string
+	// use ON CONFLICT DO NOTHING in place of INSERT IGNORE
+	onConflictIgnore bool
+	// use $1, $2... rather than ? for parameters
+	numberedParams bool
+	// the driver can only execute one statement at a time
+	splitStatements bool
+	// there are no row locks, e.g. SQLite, which locks the whole
+	// database for writes instead, so drop FOR UPDATE
+	noRowLocks bool
+}
+
+func (dialect *SqlDialect) sql(query string) string {
+	if dialect.selectUsersSql != SELECT_USERS_SQL {
+		query = strings.Replace(query, SELECT_USERS_SQL, dialect.selectUsersSql, 1)
+	}
+
+	if dialect.onConflictIgnore && strings.HasPrefix(query, "INSERT IGNORE INTO") {
+		query = "INSERT INTO" + strings.TrimPrefix(query, "INSERT IGNORE INTO") + " ON CONFLICT DO NOTHING"
+	}
+
+	if dialect.noRowLocks {
+		query = strings.TrimSuffix(query, " FOR UPDATE")
+	}
+
+	if dialect.numberedParams {
+		query = numberParams(query)
+	}
+
+	return query
+}
+
+// Split a migration script into statements the driver can
+// execute. Statements must end with a semicolon at the end of
+// a line.
+func (dialect *SqlDialect) statements(script string) []string {
+	if !dialect.splitStatements {
+		return []string{script}
+	}
+
+	var stmts []string
+	var b strings.Builder
+
+	for _, line := range strings.Split(script, "\n") {
+		b.WriteString(line)
+		b.WriteString("\n")
+
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			stmts = append(stmts, b.String())
+			b.Reset()
+		}
+	}
+
+	if strings.TrimSpace(b.String()) != "" {
+		stmts = append(stmts, b.String())
+	}
+
+	return stmts
+}
+
+// Replace ? placeholders with $1, $2... ignoring any
+// that appear inside quoted strings
+func numberParams(query string) string {
+	var b strings.Builder
+
+	n := 0
+	inQuote := false
+
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			inQuote = !inQuote
+			b.WriteRune(c)
+		case c == '?' && !inQuote:
+			n++
+			b.WriteString("$")
+			b.WriteString(strconv.Itoa(n))
+		default:
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
+
+// Split a dsn of the form scheme://... into the dialect it
+// refers to and the dsn the driver expects
+func parseDSN(dsn string) (*SqlDialect, string, error) {
+	scheme, rest, found := strings.Cut(dsn, "://")
+
+	if !found {
+		return nil, "", fmt.Errorf("database dsn must start with a scheme such as mysql://")
+	}
+
+	switch strings.ToLower(scheme) {
+	case "mysql":
+		return MYSQL_DIALECT, rest, nil
+	case "sqlite", "sqlite3":
+		return SQLITE_DIALECT, rest, nil
+	case "postgres", "postgresql":
+		// pgx understands the url form directly
+		return POSTGRES_DIALECT, dsn, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported database: %s", scheme)
+	}
+}
+
+// SQLite does not enforce foreign keys unless asked to and we
+// rely on them to remove a user's roles and keys with the user.
+// A busy timeout lets concurrent writers wait for each other
+// rather than fail.
+func sqliteDSN(dsn string) string {
+	if !strings.Contains(dsn, "_foreign_keys") && !strings.Contains(dsn, "_fk") {
+		dsn = addDSNParam(dsn, "_foreign_keys=on")
+	}
+
+	if !strings.Contains(dsn, "_busy_timeout") && !strings.Contains(dsn, "_timeout") {
+		dsn = addDSNParam(dsn, "_busy_timeout=5000")
+	}
+
+	return dsn
+}
+
+func addDSNParam(dsn string, param string) string {
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + param
+	}
+
+	return dsn + "?" + param
+}
@@ -0,0 +1,479 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	JWKS_PATH = "/.well-known/jwks.json"
+	// how long clients may cache the key set. Keep this shorter
+	// than the interval between key rotations.
+	DEFAULT_JWKS_MAX_AGE = 5 * time.Minute
+	// stops tokens with made up kids from making us hit the
+	// jwks endpoint on every request
+	JWKS_MIN_REFRESH = 30 * time.Second
+	// how long after the cache expires keys are still used if the
+	// jwks endpoint cannot be reached
+	DEFAULT_JWKS_MAX_STALE = time.Hour
+)
+
+// A public key in RFC 7517 format. RSA keys use n and e, EC and
+// OKP (ed25519) keys use crv and x, plus y for EC.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Finds the key a token was signed with from the kid in its
+// header. An empty id asks for the default key.
+type KeySource interface {
+	VerificationKey(ctx context.Context, id string) (*SigningKey, error)
+}
+
+// The members of a JWK describing a public key, without a kid
+func NewJWK(publicKey crypto.PublicKey) (*JWK, error) {
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		return &JWK{Kty: "RSA",
+			N: base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("only P-256 ecdsa keys are supported")
+		}
+
+		ecdhKey, err := k.ECDH()
+
+		if err != nil {
+			return nil, err
+		}
+
+		// uncompressed point, 0x04 || x || y
+		point := ecdhKey.Bytes()
+
+		return &JWK{Kty: "EC",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(point[1:33]),
+			Y:   base64.RawURLEncoding.EncodeToString(point[33:])}, nil
+	case ed25519.PublicKey:
+		return &JWK{Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(k)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", publicKey)
+	}
+}
+
+// The public key from a JWK
+func (jwk *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+
+		if err != nil || len(n) == 0 {
+			return nil, fmt.Errorf("key %s has an invalid modulus", jwk.Kid)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("key %s has an invalid exponent", jwk.Kid)
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("key %s uses unsupported curve %s", jwk.Kid, jwk.Crv)
+		}
+
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("key %s has an invalid point", jwk.Kid)
+		}
+
+		// checks the point is on the curve
+		_, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...))
+
+		if err != nil {
+			return nil, fmt.Errorf("key %s has an invalid point", jwk.Kid)
+		}
+
+		return &ecdsa.PublicKey{Curve: elliptic.P256(),
+			X: new(big.Int).SetBytes(x),
+			Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("key %s uses unsupported curve %s", jwk.Kid, jwk.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %s has an invalid public key", jwk.Kid)
+		}
+
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("key %s has unsupported type %s", jwk.Kid, jwk.Kty)
+	}
+}
+
+// The verification key a JWK describes. If the JWK names an
+// algorithm it must be the one used with its key type.
+func (jwk *JWK) VerificationKey() (*SigningKey, error) {
+	publicKey, err := jwk.PublicKey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	alg, err := KeyAlgorithm(publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if jwk.Alg != "" && jwk.Alg != alg {
+		return nil, fmt.Errorf("key %s cannot be used with %s", jwk.Kid, jwk.Alg)
+	}
+
+	return &SigningKey{Id: jwk.Kid,
+		PublicKey: publicKey,
+		Algorithm: alg,
+		CreatedAt: time.Now()}, nil
+}
+
+// The public keys of the ring for publishing, current key first
+func (keys *KeyRing) JWKS() (*JWKS, error) {
+	ring := keys.Keys()
+
+	jwks := JWKS{Keys: make([]JWK, 0, len(ring))}
+
+	for _, key := range ring {
+		jwk, err := NewJWK(key.PublicKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		jwk.Kid = key.Id
+		jwk.Use = "sig"
+		jwk.Alg = key.Algorithm
+
+		jwks.Keys = append(jwks.Keys, *jwk)
+	}
+
+	return &jwks, nil
+}
+
+func (keys *KeyRing) VerificationKey(ctx context.Context, id string) (*SigningKey, error) {
+	if id == "" {
+		return keys.Current(), nil
+	}
+
+	key, ok := keys.Key(id)
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", id)
+	}
+
+	return key, nil
+}
+
+// Serves the public keys of a key ring as a JWKS document so other
+// services can verify our tokens, usually at JWKS_PATH. The ETag
+// lets clients revalidate cheaply once maxAge has passed.
+func JWKSHandler(keys *KeyRing, maxAge time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		jwks, err := keys.JWKS()
+
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		data, err := json.Marshal(jwks)
+
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		sum := sha256.Sum256(data)
+		etag := fmt.Sprintf(`"%s"`, base64.RawURLEncoding.EncodeToString(sum[:16]))
+
+		c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d, must-revalidate", int(maxAge.Seconds())))
+		c.Header("ETag", etag)
+
+		if c.GetHeader("If-None-Match") == etag {
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		c.Data(http.StatusOK, "application/json", data)
+	}
+}
+
+// Fetches and caches the keys published by a JWKS endpoint so
+// tokens issued by another service can be verified. Keys are
+// refreshed when the cache expires, or early when a token names a
+// key we have not seen, which happens just after a rotation. The
+// server is asked at most once every JWKS_MIN_REFRESH, even if it is
+// failing, and cached keys are used while a refresh is running.
+//
+// If the server cannot be reached, expired keys are used for up to
+// maxStale. After that every lookup fails until the server responds
+// again, so keys it has retired, perhaps because they leaked, are not
+// trusted forever.
+type JWKSClient struct {
+	url    string
+	client *http.Client
+	// used when the server does not send a max-age
+	ttl       time.Duration
+	maxStale  time.Duration
+	keys      map[string]*SigningKey
+	defaultId string
+	expires   time.Time
+	// when the last refresh started
+	fetched time.Time
+	// closed when the running refresh finishes, nil if there is none
+	refreshing chan struct{}
+	// why the last refresh failed
+	err   error
+	mutex sync.Mutex
+}
+
+func NewJWKSClient(url string) *JWKSClient {
+	return &JWKSClient{url: url,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		ttl:      DEFAULT_JWKS_MAX_AGE,
+		maxStale: DEFAULT_JWKS_MAX_STALE,
+		keys:     make(map[string]*SigningKey)}
+}
+
+func (jc *JWKSClient) SetHTTPClient(client *http.Client) *JWKSClient {
+	jc.client = client
+	return jc
+}
+
+func (jc *JWKSClient) SetTTL(ttl time.Duration) *JWKSClient {
+	jc.ttl = ttl
+	return jc
+}
+
+// How long to keep using keys once the cache has expired if they
+// cannot be refreshed
+func (jc *JWKSClient) SetMaxStale(maxStale time.Duration) *JWKSClient {
+	jc.maxStale = maxStale
+	return jc
+}
+
+// The key with the given id. An empty id returns the first key
+// published, which is the current key if the server is a KeyRing.
+func (jc *JWKSClient) VerificationKey(ctx context.Context, id string) (*SigningKey, error) {
+	jc.mutex.Lock()
+
+	now := time.Now()
+	key, ok := jc.key(id, now)
+
+	var done chan struct{}
+
+	if now.Sub(jc.fetched) > JWKS_MIN_REFRESH && (!ok || now.After(jc.expires)) {
+		done = jc.startRefresh(ctx, now)
+	} else if !ok {
+		// a refresh for another unknown key may be about to add it
+		done = jc.refreshing
+	}
+
+	jc.mutex.Unlock()
+
+	// an expired key is still better than nothing while the refresh
+	// runs, or if the server is down
+	if ok {
+		return key, nil
+	}
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	jc.mutex.Lock()
+	defer jc.mutex.Unlock()
+
+	key, ok = jc.key(id, time.Now())
+
+	if ok {
+		return key, nil
+	}
+
+	if jc.err != nil {
+		return nil, jc.err
+	}
+
+	return nil, fmt.Errorf("unknown key %s", id)
+}
+
+// Keys are only returned until maxStale after the cache expired.
+// Must be called with the mutex held.
+func (jc *JWKSClient) key(id string, now time.Time) (*SigningKey, bool) {
+	if now.After(jc.expires.Add(jc.maxStale)) {
+		return nil, false
+	}
+
+	if id == "" {
+		id = jc.defaultId
+	}
+
+	key, ok := jc.keys[id]
+
+	return key, ok
+}
+
+// Fetch the keys in the background unless a fetch is already
+// running, and return a channel closed when it is done. Must be
+// called with the mutex held.
+func (jc *JWKSClient) startRefresh(ctx context.Context, now time.Time) chan struct{} {
+	if jc.refreshing != nil {
+		return jc.refreshing
+	}
+
+	done := make(chan struct{})
+
+	jc.fetched = now
+	jc.refreshing = done
+
+	// the fetch is shared, so one caller giving up should not
+	// cancel it for the others
+	ctx = context.WithoutCancel(ctx)
+
+	go func() {
+		defer close(done)
+
+		keys, defaultId, maxAge, err := jc.fetch(ctx)
+
+		jc.mutex.Lock()
+		defer jc.mutex.Unlock()
+
+		jc.refreshing = nil
+		jc.err = err
+
+		if err != nil {
+			log.Warn().Msgf("could not refresh jwks from %s: %s", jc.url, err)
+			return
+		}
+
+		jc.keys = keys
+		jc.defaultId = defaultId
+		jc.expires = now.Add(maxAge)
+	}()
+
+	return done
+}
+
+func (jc *JWKSClient) fetch(ctx context.Context) (map[string]*SigningKey, string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jc.url, nil)
+
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	resp, err := jc.client.Do(req)
+
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", 0, fmt.Errorf("jwks request failed with status %d", resp.StatusCode)
+	}
+
+	var jwks JWKS
+
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	keys := make(map[string]*SigningKey, len(jwks.Keys))
+	defaultId := ""
+
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.VerificationKey()
+
+		// skip keys we cannot use rather than losing them all
+		if err != nil {
+			log.Warn().Msgf("ignoring jwks key %s", err)
+			continue
+		}
+
+		keys[jwk.Kid] = key
+
+		if defaultId == "" {
+			defaultId = jwk.Kid
+		}
+	}
+
+	return keys, defaultId, max(cacheMaxAge(resp.Header.Get("Cache-Control"), jc.ttl), JWKS_MIN_REFRESH), nil
+}
+
+// max-age from a Cache-Control header or ttl if there is none
+func cacheMaxAge(header string, ttl time.Duration) time.Duration {
+	for _, directive := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(directive), "=")
+
+		if !ok || !strings.EqualFold(name, "max-age") {
+			continue
+		}
+
+		seconds, err := strconv.Atoi(value)
+
+		if err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	return ttl
+}
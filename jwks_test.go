@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves the keys of a ring, counting requests. Set down to make it
+// fail.
+type testJWKSServer struct {
+	*httptest.Server
+	keys *KeyRing
+	hits atomic.Int32
+	down atomic.Bool
+}
+
+func newTestJWKSServer(t *testing.T) *testJWKSServer {
+	t.Helper()
+
+	keys, err := NewKeyRing(testSigners(t)[EDDSA])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &testJWKSServer{keys: keys}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.hits.Add(1)
+
+		if server.down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		jwks, _ := server.keys.JWKS()
+
+		w.Header().Set("Cache-Control", "max-age=300")
+		json.NewEncoder(w).Encode(jwks)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// Pretend the last refresh was long enough ago that another is
+// allowed, and optionally that the cache expired age ago
+func (jc *JWKSClient) testAge(age time.Duration) {
+	jc.mutex.Lock()
+	defer jc.mutex.Unlock()
+
+	jc.fetched = time.Now().Add(-2 * JWKS_MIN_REFRESH)
+
+	if age > 0 {
+		jc.expires = time.Now().Add(-age)
+	}
+}
+
+func TestJWKSClientFetch(t *testing.T) {
+	server := newTestJWKSServer(t)
+	client := NewJWKSClient(server.URL)
+
+	current := server.keys.Current()
+
+	key, err := client.VerificationKey(t.Context(), current.Id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.Id != current.Id || key.Algorithm != EDDSA {
+		t.Fatalf("got key %s %s", key.Id, key.Algorithm)
+	}
+
+	// the first key is the default
+	key, err = client.VerificationKey(t.Context(), "")
+
+	if err != nil || key.Id != current.Id {
+		t.Fatalf("default key: %v", err)
+	}
+
+	// served from the cache
+	if server.hits.Load() != 1 {
+		t.Fatalf("%d requests", server.hits.Load())
+	}
+}
+
+func TestJWKSClientVerifiesTokens(t *testing.T) {
+	server := newTestJWKSServer(t)
+
+	token, err := NewTokenCreatorWithKeyRing(server.keys).AccessToken(nil, "ann", ROLE_USER)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := NewRemoteTokenVerifier(server.URL).Verify(t.Context(), token, ACCESS_TOKEN)
+
+	if err != nil || claims.UserId != "ann" {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestJWKSClientUnknownKid(t *testing.T) {
+	server := newTestJWKSServer(t)
+	client := NewJWKSClient(server.URL)
+
+	_, err := client.VerificationKey(t.Context(), "made-up")
+
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// more made up kids do not hit the server again
+	for range 5 {
+		_, err = client.VerificationKey(t.Context(), "made-up")
+
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	if server.hits.Load() != 1 {
+		t.Fatalf("%d requests", server.hits.Load())
+	}
+}
+
+// A kid we have not seen refreshes early, e.g. after a rotation
+func TestJWKSClientRefreshOnRotation(t *testing.T) {
+	server := newTestJWKSServer(t)
+	client := NewJWKSClient(server.URL)
+
+	old := server.keys.Current()
+
+	_, err := client.VerificationKey(t.Context(), old.Id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server.keys.Rotate(testSigners(t)[ES256])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := server.keys.Current()
+
+	// too soon after the last refresh
+	_, err = client.VerificationKey(t.Context(), current.Id)
+
+	if err == nil {
+		t.Fatal("refreshed within JWKS_MIN_REFRESH")
+	}
+
+	client.testAge(0)
+
+	key, err := client.VerificationKey(t.Context(), current.Id)
+
+	if err != nil || key.Algorithm != ES256 {
+		t.Fatalf("new key: %v", err)
+	}
+
+	// the old key is still published so still works
+	_, err = client.VerificationKey(t.Context(), old.Id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.hits.Load() != 2 {
+		t.Fatalf("%d requests", server.hits.Load())
+	}
+}
+
+func TestJWKSClientBackoff(t *testing.T) {
+	server := newTestJWKSServer(t)
+	server.down.Store(true)
+
+	client := NewJWKSClient(server.URL)
+
+	for range 5 {
+		_, err := client.VerificationKey(t.Context(), "")
+
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	if server.hits.Load() != 1 {
+		t.Fatalf("%d requests while the server is down", server.hits.Load())
+	}
+
+	server.down.Store(false)
+	client.testAge(0)
+
+	_, err := client.VerificationKey(t.Context(), "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.hits.Load() != 2 {
+		t.Fatalf("%d requests", server.hits.Load())
+	}
+}
+
+func TestJWKSClientStale(t *testing.T) {
+	server := newTestJWKSServer(t)
+	client := NewJWKSClient(server.URL).SetMaxStale(time.Hour)
+
+	id := server.keys.Current().Id
+
+	_, err := client.VerificationKey(t.Context(), id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.down.Store(true)
+
+	// expired but not for long, so the cached key is used while
+	// it refreshes in the background
+	client.testAge(time.Minute)
+
+	_, err = client.VerificationKey(t.Context(), id)
+
+	if err != nil {
+		t.Fatalf("recently expired key: %s", err)
+	}
+
+	// expired too long ago to trust
+	client.testAge(2 * time.Hour)
+
+	_, err = client.VerificationKey(t.Context(), id)
+
+	if err == nil {
+		t.Fatal("stale key was used")
+	}
+
+	// and keeps failing without another refresh
+	_, err = client.VerificationKey(t.Context(), id)
+
+	if err == nil {
+		t.Fatal("stale key was used")
+	}
+
+	server.down.Store(false)
+	client.testAge(0)
+
+	_, err = client.VerificationKey(t.Context(), id)
+
+	if err != nil {
+		t.Fatalf("after the server came back: %s", err)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":                                     time.Minute,
+		"max-age=30":                           30 * time.Second,
+		"public, max-age=300, must-revalidate": 5 * time.Minute,
+		"no-cache":                             time.Minute,
+		"max-age=-1":                           time.Minute,
+		"max-age=abc":                          time.Minute,
+	}
+
+	for header, want := range tests {
+		if got := cacheMaxAge(header, time.Minute); got != want {
+			t.Errorf("%q: got %s, want %s", header, got, want)
+		}
+	}
+}
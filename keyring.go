@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Signing algorithms we support. Each is tied to a key type, so
+// the algorithm of a key is worked out from the key itself.
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EDDSA = "EdDSA"
+)
+
+// A key tokens are signed with, identified by the kid in the token
+// header. Previous keys only have a public key or are no longer used
+// for signing, but tokens they signed can still be verified until
+// the key is retired.
+type SigningKey struct {
+	Id string
+	// anything that can sign, e.g. an *rsa.PrivateKey,
+	// *ecdsa.PrivateKey or ed25519.PrivateKey, or a key held in
+	// a hardware module. Nil if the key can only verify.
+	Signer    crypto.Signer
+	PublicKey crypto.PublicKey
+	Algorithm string
+	CreatedAt time.Time
+	// when the key stopped being the current key
+	RotatedAt time.Time
+}
+
+// One current key for signing new tokens plus the previous keys
+// outstanding tokens may have been signed with. Rotating the key
+// keeps the old key for verification so tokens already issued stay
+// valid until they expire.
+type KeyRing struct {
+	current  *SigningKey
+	previous []*SigningKey
+	mutex    sync.RWMutex
+}
+
+func NewKeyRing(signer crypto.Signer) (*KeyRing, error) {
+	key, err := NewSigningKey(signer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyRing{current: key}, nil
+}
+
+// A key ring that can only verify tokens, e.g. in a service that
+// consumes tokens but does not issue them
+func NewVerificationKeyRing(publicKey crypto.PublicKey) (*KeyRing, error) {
+	key, err := NewVerificationKey(publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyRing{current: key}, nil
+}
+
+func NewSigningKey(signer crypto.Signer) (*SigningKey, error) {
+	key, err := NewVerificationKey(signer.Public())
+
+	if err != nil {
+		return nil, err
+	}
+
+	key.Signer = signer
+
+	return key, nil
+}
+
+func NewVerificationKey(publicKey crypto.PublicKey) (*SigningKey, error) {
+	alg, err := KeyAlgorithm(publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := KeyId(publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{Id: id,
+		PublicKey: publicKey,
+		Algorithm: alg,
+		CreatedAt: time.Now()}, nil
+}
+
+func (keys *KeyRing) Current() *SigningKey {
+	keys.mutex.RLock()
+	defer keys.mutex.RUnlock()
+
+	return keys.current
+}
+
+// Find the current or a previous key by its id
+func (keys *KeyRing) Key(id string) (*SigningKey, bool) {
+	keys.mutex.RLock()
+	defer keys.mutex.RUnlock()
+
+	if keys.current.Id == id {
+		return keys.current, true
+	}
+
+	for _, key := range keys.previous {
+		if key.Id == id {
+			return key, true
+		}
+	}
+
+	return nil, false
+}
+
+// All the keys tokens can be verified with, current key first
+func (keys *KeyRing) Keys() []*SigningKey {
+	keys.mutex.RLock()
+	defer keys.mutex.RUnlock()
+
+	return append([]*SigningKey{keys.current}, keys.previous...)
+}
+
+// Make signer the current signing key. The old current key is kept
+// for verification.
+func (keys *KeyRing) Rotate(signer crypto.Signer) error {
+	key, err := NewSigningKey(signer)
+
+	if err != nil {
+		return err
+	}
+
+	keys.mutex.Lock()
+	defer keys.mutex.Unlock()
+
+	// copy so keys handed out earlier are not modified
+	old := *keys.current
+	old.RotatedAt = time.Now()
+
+	keys.previous = append([]*SigningKey{&old}, keys.previous...)
+	keys.current = key
+
+	return nil
+}
+
+// Accept tokens signed by another key, e.g. the key used before
+// a restart. The key is retired like any other previous key.
+func (keys *KeyRing) AddVerificationKey(publicKey crypto.PublicKey) error {
+	key, err := NewVerificationKey(publicKey)
+
+	if err != nil {
+		return err
+	}
+
+	keys.mutex.Lock()
+	defer keys.mutex.Unlock()
+
+	if keys.current.Id == key.Id || slices.ContainsFunc(keys.previous, func(k *SigningKey) bool { return k.Id == key.Id }) {
+		return nil
+	}
+
+	key.RotatedAt = key.CreatedAt
+
+	keys.previous = append(keys.previous, key)
+
+	return nil
+}
+
+// Remove previous keys rotated out more than maxAge ago. Once maxAge
+// is longer than any token TTL, no valid token can need them.
+func (keys *KeyRing) Retire(maxAge time.Duration) {
+	keys.mutex.Lock()
+	defer keys.mutex.Unlock()
+
+	cutoff := time.Now().Add(-maxAge)
+
+	keys.previous = slices.DeleteFunc(keys.previous, func(key *SigningKey) bool {
+		return key.RotatedAt.Before(cutoff)
+	})
+}
+
+// Rotate to a new key from generate every interval and retire keys
+// once retireAfter has passed, until ctx is cancelled. Errors
+// generating keys are logged and the current key is kept.
+func (keys *KeyRing) StartRotation(ctx context.Context,
+	interval time.Duration,
+	retireAfter time.Duration,
+	generate func() (crypto.Signer, error)) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				signer, err := generate()
+
+				if err == nil {
+					err = keys.Rotate(signer)
+				}
+
+				if err != nil {
+					log.Error().Msgf("could not rotate signing key %s", err)
+				}
+
+				keys.Retire(retireAfter)
+			}
+		}
+	}()
+}
+
+// Sign the header and claims of a jwt. Signers only sign digests
+// (except ed25519) and ecdsa signers return DER, so the signature
+// is converted to the fixed size form JWS expects.
+func (key *SigningKey) Sign(signingString string) ([]byte, error) {
+	if key.Signer == nil {
+		return nil, fmt.Errorf("key %s cannot sign tokens", key.Id)
+	}
+
+	switch key.Algorithm {
+	case RS256:
+		digest := sha256.Sum256([]byte(signingString))
+
+		return key.Signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ES256:
+		digest := sha256.Sum256([]byte(signingString))
+
+		der, err := key.Signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var sig struct {
+			R, S *big.Int
+		}
+
+		_, err = asn1.Unmarshal(der, &sig)
+
+		if err != nil {
+			return nil, err
+		}
+
+		out := make([]byte, 64)
+		sig.R.FillBytes(out[:32])
+		sig.S.FillBytes(out[32:])
+
+		return out, nil
+	case EDDSA:
+		return key.Signer.Sign(rand.Reader, []byte(signingString), crypto.Hash(0))
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", key.Algorithm)
+	}
+}
+
+// The algorithm used with a key: RS256 for rsa, ES256 for P-256
+// and EdDSA for ed25519 keys
+func KeyAlgorithm(publicKey crypto.PublicKey) (string, error) {
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		return RS256, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", fmt.Errorf("only P-256 ecdsa keys are supported")
+		}
+
+		return ES256, nil
+	case ed25519.PublicKey:
+		return EDDSA, nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", publicKey)
+	}
+}
+
+// The RFC 7638 thumbprint of a public key, which is stable so the
+// same key always gets the same kid
+func KeyId(publicKey crypto.PublicKey) (string, error) {
+	jwk, err := NewJWK(publicKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	// required members only, in lexicographic order with no whitespace
+	var thumbprint string
+
+	switch jwk.Kty {
+	case "RSA":
+		thumbprint = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "EC":
+		thumbprint = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Crv, jwk.X, jwk.Y)
+	default:
+		thumbprint = fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s"}`, jwk.Crv, jwk.Kty, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(thumbprint))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
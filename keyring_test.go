@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testSigners(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]crypto.Signer{RS256: rsaKey, ES256: ecKey, EDDSA: edKey}
+}
+
+// Sign a jwt with SigningKey.Sign and check golang-jwt accepts it
+func TestSigningKeySignRoundTrip(t *testing.T) {
+	for alg, signer := range testSigners(t) {
+		key, err := NewSigningKey(signer)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if key.Algorithm != alg {
+			t.Fatalf("%s: got algorithm %s", alg, key.Algorithm)
+		}
+
+		token := jwt.NewWithClaims(jwt.GetSigningMethod(alg), jwt.MapClaims{"sub": "ann"})
+		token.Header["kid"] = key.Id
+
+		signingString, err := token.SigningString()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// ecdsa signatures are DER encoded by the signer, so convert
+		// them often enough to hit r or s with leading zeros
+		n := 1
+
+		if alg == ES256 {
+			n = 500
+		}
+
+		for range n {
+			sig, err := key.Sign(signingString)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if alg == ES256 && len(sig) != 64 {
+				t.Fatalf("ES256 signature is %d bytes", len(sig))
+			}
+
+			err = jwt.GetSigningMethod(alg).Verify(signingString, sig, signer.Public())
+
+			if err != nil {
+				t.Fatalf("%s: %s", alg, err)
+			}
+		}
+
+		sig, _ := key.Sign(signingString)
+
+		parsed, err := jwt.Parse(signingString+"."+base64.RawURLEncoding.EncodeToString(sig),
+			func(token *jwt.Token) (any, error) { return signer.Public(), nil },
+			jwt.WithValidMethods([]string{alg}))
+
+		if err != nil || !parsed.Valid {
+			t.Fatalf("%s: %v", alg, err)
+		}
+
+		// and a different key of the same type must not verify it
+		other := testSigners(t)[alg]
+
+		err = jwt.GetSigningMethod(alg).Verify(signingString, sig, other.Public())
+
+		if err == nil {
+			t.Fatalf("%s: verified with the wrong key", alg)
+		}
+	}
+}
+
+func TestVerificationKeyCannotSign(t *testing.T) {
+	key, err := NewVerificationKey(testSigners(t)[EDDSA].Public())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = key.Sign("header.claims")
+
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestKeyAlgorithmUnsupported(t *testing.T) {
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	_, err := NewSigningKey(p384)
+
+	if err == nil {
+		t.Fatal("P-384 keys should not be supported")
+	}
+}
+
+func TestKeyIdIsStable(t *testing.T) {
+	signers := testSigners(t)
+	ids := make(map[string]bool)
+
+	for alg, signer := range signers {
+		id, err := KeyId(signer.Public())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		again, _ := KeyId(signer.Public())
+
+		if id != again {
+			t.Fatalf("%s: kid changed", alg)
+		}
+
+		ids[id] = true
+	}
+
+	if len(ids) != len(signers) {
+		t.Fatal("keys share a kid")
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	signers := testSigners(t)
+
+	keys, err := NewKeyRing(signers[RS256])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := keys.Current()
+
+	err = keys.Rotate(signers[ES256])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := keys.Current()
+
+	if second.Algorithm != ES256 || second.Id == first.Id {
+		t.Fatalf("current key is %s", second.Algorithm)
+	}
+
+	// the old key is kept for verification
+	old, ok := keys.Key(first.Id)
+
+	if !ok || old.RotatedAt.IsZero() {
+		t.Fatal("old key was not kept")
+	}
+
+	// keys handed out before rotating are not changed
+	if !first.RotatedAt.IsZero() {
+		t.Fatal("old key was modified")
+	}
+
+	err = keys.Rotate(signers[EDDSA])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := keys.Keys()
+
+	if len(all) != 3 || all[0].Algorithm != EDDSA || all[1].Id != second.Id || all[2].Id != first.Id {
+		t.Fatal("keys are not newest first")
+	}
+
+	// adding a key already in the ring does nothing
+	err = keys.AddVerificationKey(signers[RS256].Public())
+
+	if err != nil || len(keys.Keys()) != 3 {
+		t.Fatal("duplicate key added")
+	}
+
+	keys.Retire(time.Hour)
+
+	if len(keys.Keys()) != 3 {
+		t.Fatal("recent keys were retired")
+	}
+
+	keys.Retire(0)
+
+	if len(keys.Keys()) != 1 {
+		t.Fatal("old keys were not retired")
+	}
+
+	_, ok = keys.Key(first.Id)
+
+	if ok {
+		t.Fatal("retired key can still be found")
+	}
+
+	// the current key is never retired
+	if keys.Current().Algorithm != EDDSA {
+		t.Fatal("current key changed")
+	}
+}
+
+// Tokens signed before a rotation verify until the old key retires
+func TestKeyRingRotationTokens(t *testing.T) {
+	signers := testSigners(t)
+
+	keys, err := NewKeyRing(signers[ES256])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creator := NewTokenCreatorWithKeyRing(keys)
+	verifier := NewTokenVerifierWithKeyRing(keys)
+
+	token, err := creator.AccessToken(nil, "ann", ROLE_USER)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = keys.Rotate(signers[EDDSA])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = verifier.Verify(t.Context(), token, ACCESS_TOKEN)
+
+	if err != nil {
+		t.Fatalf("token from before the rotation: %s", err)
+	}
+
+	newToken, err := creator.AccessToken(nil, "ann", ROLE_USER)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys.Retire(0)
+
+	_, err = verifier.Verify(t.Context(), token, ACCESS_TOKEN)
+
+	if err == nil {
+		t.Fatal("token signed by a retired key was accepted")
+	}
+
+	_, err = verifier.Verify(t.Context(), newToken, ACCESS_TOKEN)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -35,6 +35,16 @@ type NewPasswordReq struct {
 	NewPassword string `json:"newPassword"`
 }
 
+// Second step of signing in with mfa, the mfa_pending token from
+// the first step and either a code from the user's authenticator,
+// a passkey or one of their recovery codes
+type MfaLoginReq struct {
+	Token        string                `json:"token"`
+	Code         string                `json:"code"`
+	Passkey      *WebAuthnAssertionReq `json:"passkey,omitempty"`
+	RecoveryCode string                `json:"recoveryCode"`
+}
+
 type ApiKeyLoginReq struct {
 	Key string `json:"key"`
 }
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"context"
+)
+
+// What failed sign ins are counted against
+const (
+	// subject is the user's uuid
+	LOGIN_SCOPE_USER = "user"
+	// wrong second factors, e.g. totp codes, also by uuid. These are
+	// kept apart from password failures so signing in with the right
+	// password does not reset them.
+	LOGIN_SCOPE_MFA = "mfa"
+	// subject is the client's ip address
+	LOGIN_SCOPE_IP = "ip"
+)
+
+// Recent failed sign ins for an account or ip address. UnlockAt is 0
+// if it has never been locked out.
+type LoginFailures struct {
+	Scope        string `json:"scope"`
+	Subject      string `json:"subject"`
+	Failures     uint   `json:"failures"`
+	LastFailedAt int64  `json:"lastFailedAt"`
+	UnlockAt     int64  `json:"unlockAt"`
+}
+
+type LoginFailureStore interface {
+	// Count a failure and return how many there have been. Failures
+	// last seen before resetBefore are forgotten first.
+	AddLoginFailure(ctx context.Context, scope string, subject string, failedAt int64, resetBefore int64) (uint, error)
+	// Refuse sign ins until unlockAt
+	SetLoginUnlockAt(ctx context.Context, scope string, subject string, unlockAt int64) error
+	// Returns sql.ErrNoRows if there have been no recent failures
+	FindLoginFailures(ctx context.Context, scope string, subject string) (*LoginFailures, error)
+	// Everything still locked out at now, soonest to unlock first
+	LockedLogins(ctx context.Context, now int64) ([]*LoginFailures, error)
+	ClearLoginFailures(ctx context.Context, scope string, subject string) error
+	// Remove records last failed and unlocked before before
+	DeleteExpiredLoginFailures(ctx context.Context, before int64) error
+}
+
+// the count starts again if the last failure was too long ago
+const UPDATE_LOGIN_FAILURE_SQL = `UPDATE login_failures
+	SET failures = CASE WHEN last_failed_at < ? THEN 1 ELSE failures + 1 END, last_failed_at = ?
+	WHERE scope = ? AND subject = ?`
+
+const INSERT_LOGIN_FAILURE_SQL = `INSERT IGNORE INTO login_failures (scope, subject, failures, last_failed_at, unlock_at) VALUES (?, ?, 1, ?, 0)`
+
+const LOGIN_FAILURE_COUNT_SQL = `SELECT failures FROM login_failures WHERE scope = ? AND subject = ?`
+
+const SET_LOGIN_UNLOCK_AT_SQL = `UPDATE login_failures SET unlock_at = ? WHERE scope = ? AND subject = ?`
+
+const FIND_LOGIN_FAILURES_SQL = `SELECT scope, subject, failures, last_failed_at, unlock_at
+	FROM login_failures
+	WHERE scope = ? AND subject = ?`
+
+const LOCKED_LOGINS_SQL = `SELECT scope, subject, failures, last_failed_at, unlock_at
+	FROM login_failures
+	WHERE unlock_at > ?
+	ORDER BY unlock_at, scope, subject`
+
+const DELETE_LOGIN_FAILURES_SQL = `DELETE FROM login_failures WHERE scope = ? AND subject = ?`
+
+const DELETE_EXPIRED_LOGIN_FAILURES_SQL = `DELETE FROM login_failures WHERE last_failed_at < ? AND unlock_at < ?`
+
+const DELETE_USER_LOGIN_FAILURES_SQL = `DELETE FROM login_failures WHERE scope IN ('user', 'mfa') AND subject = ?`
+
+const USERS_UNLOCK_AT_SQL string = `SELECT
+	users.id, login_failures.unlock_at
+	FROM login_failures
+	JOIN users ON users.uuid = login_failures.subject
+	WHERE login_failures.scope IN ('user', 'mfa') AND login_failures.unlock_at > 0 AND users.id IN (%s)`
+
+func (userdb *UserDb) AddLoginFailure(ctx context.Context, scope string, subject string, failedAt int64, resetBefore int64) (uint, error) {
+	var failures uint
+
+	err := userdb.withTx(ctx, func(tx *UserDb) error {
+		result, err := tx.exec(ctx, UPDATE_LOGIN_FAILURE_SQL, resetBefore, failedAt, scope, subject)
+
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+
+		if err != nil {
+			return err
+		}
+
+		// first failure. If another sign in got there first the
+		// insert is ignored and this one is not counted, which
+		// is close enough.
+		if n == 0 {
+			_, err = tx.exec(ctx, INSERT_LOGIN_FAILURE_SQL, scope, subject, failedAt)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.queryRow(ctx, LOGIN_FAILURE_COUNT_SQL, scope, subject).Scan(&failures)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return failures, nil
+}
+
+func (userdb *UserDb) SetLoginUnlockAt(ctx context.Context, scope string, subject string, unlockAt int64) error {
+	_, err := userdb.exec(ctx, SET_LOGIN_UNLOCK_AT_SQL, unlockAt, scope, subject)
+
+	return err
+}
+
+func (userdb *UserDb) FindLoginFailures(ctx context.Context, scope string, subject string) (*LoginFailures, error) {
+	return scanLoginFailures(userdb.queryRow(ctx, FIND_LOGIN_FAILURES_SQL, scope, subject))
+}
+
+func (userdb *UserDb) LockedLogins(ctx context.Context, now int64) ([]*LoginFailures, error) {
+	rows, err := userdb.query(ctx, LOCKED_LOGINS_SQL, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	locked := make([]*LoginFailures, 0, 10)
+
+	for rows.Next() {
+		failures, err := scanLoginFailures(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		locked = append(locked, failures)
+	}
+
+	return locked, rows.Err()
+}
+
+func (userdb *UserDb) ClearLoginFailures(ctx context.Context, scope string, subject string) error {
+	_, err := userdb.exec(ctx, DELETE_LOGIN_FAILURES_SQL, scope, subject)
+
+	return err
+}
+
+func (userdb *UserDb) DeleteExpiredLoginFailures(ctx context.Context, before int64) error {
+	_, err := userdb.exec(ctx, DELETE_EXPIRED_LOGIN_FAILURES_SQL, before, before)
+
+	return err
+}
+
+func scanLoginFailures(row rowScanner) (*LoginFailures, error) {
+	var failures LoginFailures
+
+	err := row.Scan(&failures.Scope,
+		&failures.Subject,
+		&failures.Failures,
+		&failures.LastFailedAt,
+		&failures.UnlockAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &failures, nil
+}
@@ -0,0 +1,337 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// failed sign ins allowed before an account is locked out
+	DEFAULT_MAX_LOGIN_FAILURES = 5
+	// ip addresses get more since several users may share one
+	DEFAULT_MAX_IP_LOGIN_FAILURES = 20
+	// the first lockout, which doubles with each further failure
+	DEFAULT_LOGIN_LOCKOUT     = time.Minute
+	DEFAULT_MAX_LOGIN_LOCKOUT = time.Hour
+	// failures are forgotten once there have been none for this long
+	DEFAULT_LOGIN_FAILURE_RESET = 24 * time.Hour
+)
+
+var ErrLoginLocked = errors.New("too many failed sign in attempts")
+
+// Returned while an account or ip address is locked out. Unwraps to
+// ErrLoginLocked. Handlers can use UnlockAt for a Retry-After header.
+type LoginLockedError struct {
+	UnlockAt time.Time
+}
+
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("too many failed sign in attempts, try again after %s", e.UnlockAt.UTC().Format(time.RFC3339))
+}
+
+func (e *LoginLockedError) Unwrap() error {
+	return ErrLoginLocked
+}
+
+// Counts failed sign ins per account and per ip address. Once there
+// have been too many, sign ins are refused for a while, and each
+// further failure doubles the wait up to a maximum. A successful
+// sign in clears the account's count but not the ip's, otherwise an
+// attacker could reset it by signing in to their own account.
+//
+// This is separate from AuthUser.IsLocked, which admins set by hand
+// and which never expires.
+type LoginThrottle struct {
+	store          UserStore
+	maxFailures    uint
+	maxIpFailures  uint
+	lockout        time.Duration
+	maxLockout     time.Duration
+	resetAfter     time.Duration
+	securityEvents SecurityEventHandler
+}
+
+func NewLoginThrottle(store UserStore) *LoginThrottle {
+	return &LoginThrottle{store: store,
+		maxFailures:    DEFAULT_MAX_LOGIN_FAILURES,
+		maxIpFailures:  DEFAULT_MAX_IP_LOGIN_FAILURES,
+		lockout:        DEFAULT_LOGIN_LOCKOUT,
+		maxLockout:     DEFAULT_MAX_LOGIN_LOCKOUT,
+		resetAfter:     DEFAULT_LOGIN_FAILURE_RESET,
+		securityEvents: LogSecurityEvent}
+}
+
+// Failures allowed per account before it is locked out. 0 turns off
+// account lockouts.
+func (lt *LoginThrottle) SetMaxFailures(failures uint) *LoginThrottle {
+	lt.maxFailures = failures
+	return lt
+}
+
+// Failures allowed per ip address before it is locked out. 0 turns
+// off ip lockouts.
+func (lt *LoginThrottle) SetMaxIpFailures(failures uint) *LoginThrottle {
+	lt.maxIpFailures = failures
+	return lt
+}
+
+// The first lockout and the most it can double to
+func (lt *LoginThrottle) SetLockout(lockout time.Duration, maxLockout time.Duration) *LoginThrottle {
+	lt.lockout = lockout
+	lt.maxLockout = maxLockout
+	return lt
+}
+
+// How long without a failure before the count starts again
+func (lt *LoginThrottle) SetResetAfter(resetAfter time.Duration) *LoginThrottle {
+	lt.resetAfter = resetAfter
+	return lt
+}
+
+func (lt *LoginThrottle) SetSecurityEventHandler(handler SecurityEventHandler) *LoginThrottle {
+	lt.securityEvents = handler
+	return lt
+}
+
+// Check a user's password on sign in, refusing it while the user or
+// ip is locked out. Either can be empty, e.g. ip when there is no
+// client address.
+func (lt *LoginThrottle) VerifyPassword(ctx context.Context, user *AuthUser, ip string, password string) error {
+	err := lt.Check(ctx, user, ip)
+
+	if err != nil {
+		return err
+	}
+
+	err = lt.store.VerifyPassword(ctx, user, password)
+
+	if errors.Is(err, ErrPasswordsDoNotMatch) {
+		lerr := lt.Fail(ctx, user, ip)
+
+		// still tell the user their password was wrong
+		if lerr != nil {
+			log.Error().Msgf("could not record failed sign in for %s: %s", user.Uuid, lerr)
+		}
+
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return lt.Succeed(ctx, user)
+}
+
+// Returns a *LoginLockedError if the user or ip is locked out. user
+// can be nil to only check the ip.
+func (lt *LoginThrottle) Check(ctx context.Context, user *AuthUser, ip string) error {
+	now := time.Now().Unix()
+
+	if user != nil {
+		err := lt.checkLocked(ctx, LOGIN_SCOPE_USER, user.Uuid, now)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if ip != "" {
+		return lt.checkLocked(ctx, LOGIN_SCOPE_IP, ip, now)
+	}
+
+	return nil
+}
+
+// Record a failed sign in, locking out the user or ip if there have
+// been too many. Call this with a nil user when someone tries to sign
+// in as a user that does not exist so the ip is still counted.
+func (lt *LoginThrottle) Fail(ctx context.Context, user *AuthUser, ip string) error {
+	now := time.Now()
+
+	if user != nil {
+		unlockAt, err := lt.fail(ctx, LOGIN_SCOPE_USER, user.Uuid, lt.maxFailures, now, func(event *SecurityEvent) {
+			event.UserId = user.Uuid
+			event.Ip = ip
+		})
+
+		if err != nil {
+			return err
+		}
+
+		user.UnlockAt = unlockAt
+	}
+
+	if ip != "" {
+		_, err := lt.fail(ctx, LOGIN_SCOPE_IP, ip, lt.maxIpFailures, now, func(event *SecurityEvent) {
+			event.Ip = ip
+		})
+
+		return err
+	}
+
+	return nil
+}
+
+// Forget a user's password failures after they sign in. Second
+// factor failures are kept until SucceedMfa.
+func (lt *LoginThrottle) Succeed(ctx context.Context, user *AuthUser) error {
+	user.UnlockAt = 0
+
+	return lt.store.ClearLoginFailures(ctx, LOGIN_SCOPE_USER, user.Uuid)
+}
+
+// Returns a *LoginLockedError if the user is locked out, whether for
+// wrong passwords or wrong second factors. Check this before
+// verifying a totp or recovery code.
+func (lt *LoginThrottle) CheckMfa(ctx context.Context, user *AuthUser) error {
+	now := time.Now().Unix()
+
+	err := lt.checkLocked(ctx, LOGIN_SCOPE_USER, user.Uuid, now)
+
+	if err != nil {
+		return err
+	}
+
+	return lt.checkLocked(ctx, LOGIN_SCOPE_MFA, user.Uuid, now)
+}
+
+// Record a wrong second factor, locking the user out if there have
+// been too many
+func (lt *LoginThrottle) FailMfa(ctx context.Context, user *AuthUser) error {
+	unlockAt, err := lt.fail(ctx, LOGIN_SCOPE_MFA, user.Uuid, lt.maxFailures, time.Now(), func(event *SecurityEvent) {
+		event.UserId = user.Uuid
+	})
+
+	if err != nil {
+		return err
+	}
+
+	user.UnlockAt = max(user.UnlockAt, unlockAt)
+
+	return nil
+}
+
+// Forget a user's second factor failures once they have signed in
+func (lt *LoginThrottle) SucceedMfa(ctx context.Context, user *AuthUser) error {
+	return lt.store.ClearLoginFailures(ctx, LOGIN_SCOPE_MFA, user.Uuid)
+}
+
+// Accounts and ip addresses that are currently locked out, for
+// admins
+func (lt *LoginThrottle) Lockouts(ctx context.Context) ([]*LoginFailures, error) {
+	return lt.store.LockedLogins(ctx, time.Now().Unix())
+}
+
+// A user's recent failures. Failures is 0 if there have been none.
+func (lt *LoginThrottle) UserFailures(ctx context.Context, user *AuthUser) (*LoginFailures, error) {
+	return lt.failures(ctx, LOGIN_SCOPE_USER, user.Uuid)
+}
+
+func (lt *LoginThrottle) IpFailures(ctx context.Context, ip string) (*LoginFailures, error) {
+	return lt.failures(ctx, LOGIN_SCOPE_IP, ip)
+}
+
+// End a user's lockout and forget their password and second factor
+// failures
+func (lt *LoginThrottle) Unlock(ctx context.Context, user *AuthUser) error {
+	user.UnlockAt = 0
+
+	err := lt.store.ClearLoginFailures(ctx, LOGIN_SCOPE_USER, user.Uuid)
+
+	if err != nil {
+		return err
+	}
+
+	return lt.store.ClearLoginFailures(ctx, LOGIN_SCOPE_MFA, user.Uuid)
+}
+
+func (lt *LoginThrottle) UnlockIp(ctx context.Context, ip string) error {
+	return lt.store.ClearLoginFailures(ctx, LOGIN_SCOPE_IP, ip)
+}
+
+// Delete records of failures that have been forgotten. Run this now
+// and then to stop old ip addresses building up.
+func (lt *LoginThrottle) DeleteExpired(ctx context.Context) error {
+	return lt.store.DeleteExpiredLoginFailures(ctx, time.Now().Add(-lt.resetAfter).Unix())
+}
+
+func (lt *LoginThrottle) checkLocked(ctx context.Context, scope string, subject string, now int64) error {
+	failures, err := lt.store.FindLoginFailures(ctx, scope, subject)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if failures.UnlockAt > now {
+		return &LoginLockedError{UnlockAt: time.Unix(failures.UnlockAt, 0)}
+	}
+
+	return nil
+}
+
+func (lt *LoginThrottle) fail(ctx context.Context,
+	scope string,
+	subject string,
+	maxFailures uint,
+	now time.Time,
+	describe func(event *SecurityEvent)) (int64, error) {
+
+	failures, err := lt.store.AddLoginFailure(ctx, scope, subject, now.Unix(), now.Add(-lt.resetAfter).Unix())
+
+	if err != nil {
+		return 0, err
+	}
+
+	if maxFailures == 0 || failures < maxFailures {
+		return 0, nil
+	}
+
+	unlockAt := now.Add(lt.lockoutFor(failures - maxFailures)).Unix()
+
+	err = lt.store.SetLoginUnlockAt(ctx, scope, subject, unlockAt)
+
+	if err != nil {
+		return 0, err
+	}
+
+	event := &SecurityEvent{Type: LOGIN_LOCKED_EVENT, Time: now}
+	describe(event)
+	lt.securityEvents(ctx, event)
+
+	return unlockAt, nil
+}
+
+// The lockout doubles for each failure past the limit
+func (lt *LoginThrottle) lockoutFor(extraFailures uint) time.Duration {
+	lockout := lt.lockout
+
+	for range extraFailures {
+		if lockout >= lt.maxLockout/2 {
+			return lt.maxLockout
+		}
+
+		lockout *= 2
+	}
+
+	return min(lockout, lt.maxLockout)
+}
+
+func (lt *LoginThrottle) failures(ctx context.Context, scope string, subject string) (*LoginFailures, error) {
+	failures, err := lt.store.FindLoginFailures(ctx, scope, subject)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return &LoginFailures{Scope: scope, Subject: subject}, nil
+	}
+
+	return failures, err
+}
@@ -0,0 +1,369 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const testPassword = "correct horse battery staple"
+
+func newTestLoginThrottle(t *testing.T) (*LoginThrottle, *MemUserDb, *AuthUser) {
+	t.Helper()
+
+	db, user := newTestUser(t)
+
+	throttle := NewLoginThrottle(db).
+		SetMaxFailures(3).
+		SetMaxIpFailures(5).
+		SetSecurityEventHandler(func(ctx context.Context, event *SecurityEvent) {})
+
+	return throttle, db, user
+}
+
+// unlockAt should be lockout from some time between start and now
+func checkUnlockAt(t *testing.T, unlockAt int64, start time.Time, lockout time.Duration) {
+	t.Helper()
+
+	if unlockAt < start.Add(lockout).Unix() || unlockAt > time.Now().Add(lockout).Unix() {
+		t.Fatalf("unlocks in %s, expected %s", time.Until(time.Unix(unlockAt, 0)).Round(time.Second), lockout)
+	}
+}
+
+func TestLoginThrottleLockoutFor(t *testing.T) {
+	throttle := NewLoginThrottle(nil).SetLockout(time.Minute, time.Hour)
+
+	tests := map[uint]time.Duration{
+		0:   time.Minute,
+		1:   2 * time.Minute,
+		2:   4 * time.Minute,
+		5:   32 * time.Minute,
+		6:   time.Hour,
+		7:   time.Hour,
+		100: time.Hour,
+	}
+
+	for extra, want := range tests {
+		if got := throttle.lockoutFor(extra); got != want {
+			t.Errorf("%d: got %s, want %s", extra, got, want)
+		}
+	}
+
+	// a max that is not a doubling of the first lockout
+	throttle.SetLockout(time.Minute, 90*time.Second)
+
+	if got := throttle.lockoutFor(1); got != 90*time.Second {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestLoginThrottleLockoutDoubles(t *testing.T) {
+	throttle, _, user := newTestLoginThrottle(t)
+
+	start := time.Now()
+
+	for range 2 {
+		err := throttle.Fail(t.Context(), user, "")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if user.UnlockAt != 0 {
+			t.Fatal("locked out too soon")
+		}
+	}
+
+	for _, lockout := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		err := throttle.Fail(t.Context(), user, "")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkUnlockAt(t, user.UnlockAt, start, lockout)
+
+		failures, err := throttle.UserFailures(t.Context(), user)
+
+		if err != nil || failures.UnlockAt != user.UnlockAt {
+			t.Fatalf("stored unlock at does not match: %v", err)
+		}
+	}
+}
+
+func TestLoginThrottleVerifyPassword(t *testing.T) {
+	throttle, db, user := newTestLoginThrottle(t)
+
+	for range 3 {
+		err := throttle.VerifyPassword(t.Context(), user, "192.0.2.1", "wrong")
+
+		if !errors.Is(err, ErrPasswordsDoNotMatch) {
+			t.Fatalf("wrong password: %v", err)
+		}
+	}
+
+	// the right password is refused without being checked
+	err := throttle.VerifyPassword(t.Context(), user, "192.0.2.1", testPassword)
+
+	var lockedErr *LoginLockedError
+
+	if !errors.As(err, &lockedErr) || !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("expected a LoginLockedError, got %v", err)
+	}
+
+	if lockedErr.UnlockAt.Unix() != user.UnlockAt {
+		t.Fatalf("error unlocks at %s", lockedErr.UnlockAt)
+	}
+
+	// users read from the store carry unlock_at too
+	found, err := db.FindUserByUuid(t.Context(), user.Uuid)
+
+	if err != nil || found.UnlockAt != user.UnlockAt {
+		t.Fatalf("stored user unlocks at %d, expected %d", found.UnlockAt, user.UnlockAt)
+	}
+
+	lockouts, err := throttle.Lockouts(t.Context())
+
+	if err != nil || len(lockouts) != 1 || lockouts[0].Scope != LOGIN_SCOPE_USER || lockouts[0].Subject != user.Uuid {
+		t.Fatalf("lockouts are %v", lockouts)
+	}
+
+	err = throttle.Unlock(t.Context(), user)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, _ = db.FindUserByUuid(t.Context(), user.Uuid)
+
+	if user.UnlockAt != 0 || found.UnlockAt != 0 {
+		t.Fatal("still locked after unlocking")
+	}
+
+	err = throttle.VerifyPassword(t.Context(), user, "192.0.2.1", testPassword)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginThrottleSucceedResets(t *testing.T) {
+	throttle, _, user := newTestLoginThrottle(t)
+
+	for range 2 {
+		throttle.VerifyPassword(t.Context(), user, "192.0.2.1", "wrong")
+	}
+
+	err := throttle.VerifyPassword(t.Context(), user, "192.0.2.1", testPassword)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures, err := throttle.UserFailures(t.Context(), user)
+
+	if err != nil || failures.Failures != 0 {
+		t.Fatalf("%d failures after signing in: %v", failures.Failures, err)
+	}
+
+	// so it takes the full count to lock out again
+	for range 2 {
+		throttle.VerifyPassword(t.Context(), user, "192.0.2.1", "wrong")
+	}
+
+	err = throttle.Check(t.Context(), user, "192.0.2.1")
+
+	if err != nil {
+		t.Fatalf("locked out early: %v", err)
+	}
+
+	// but the ip count is not reset by signing in
+	failures, err = throttle.IpFailures(t.Context(), "192.0.2.1")
+
+	if err != nil || failures.Failures != 4 {
+		t.Fatalf("ip has %d failures: %v", failures.Failures, err)
+	}
+}
+
+func TestLoginThrottleResetAfter(t *testing.T) {
+	throttle, db, user := newTestLoginThrottle(t)
+
+	throttle.SetResetAfter(time.Hour)
+
+	// two failures from long ago
+	old := time.Now().Add(-2 * time.Hour).Unix()
+
+	for range 2 {
+		db.AddLoginFailure(t.Context(), LOGIN_SCOPE_USER, user.Uuid, old, 0)
+	}
+
+	err := throttle.Fail(t.Context(), user, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures, _ := throttle.UserFailures(t.Context(), user)
+
+	if failures.Failures != 1 || user.UnlockAt != 0 {
+		t.Fatalf("%d failures, the old ones were not forgotten", failures.Failures)
+	}
+
+	db.AddLoginFailure(t.Context(), LOGIN_SCOPE_IP, "192.0.2.1", old, 0)
+
+	err = throttle.DeleteExpired(t.Context())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures, _ = throttle.IpFailures(t.Context(), "192.0.2.1")
+
+	if failures.Failures != 0 {
+		t.Fatal("old ip failures were not deleted")
+	}
+
+	failures, _ = throttle.UserFailures(t.Context(), user)
+
+	if failures.Failures != 1 {
+		t.Fatal("recent failures were deleted")
+	}
+}
+
+func TestLoginThrottleIpScope(t *testing.T) {
+	throttle, _, user := newTestLoginThrottle(t)
+
+	start := time.Now()
+
+	// unknown users still count against the ip
+	for range 5 {
+		err := throttle.Fail(t.Context(), nil, "192.0.2.1")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := throttle.Check(t.Context(), nil, "192.0.2.1")
+
+	var lockedErr *LoginLockedError
+
+	if !errors.As(err, &lockedErr) {
+		t.Fatalf("expected a LoginLockedError, got %v", err)
+	}
+
+	checkUnlockAt(t, lockedErr.UnlockAt.Unix(), start, DEFAULT_LOGIN_LOCKOUT)
+
+	// including for real users with the right password
+	err = throttle.VerifyPassword(t.Context(), user, "192.0.2.1", testPassword)
+
+	if !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("expected ErrLoginLocked, got %v", err)
+	}
+
+	// other ips and the user themselves are fine
+	err = throttle.VerifyPassword(t.Context(), user, "192.0.2.2", testPassword)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = throttle.UnlockIp(t.Context(), "192.0.2.1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = throttle.Check(t.Context(), user, "192.0.2.1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginThrottleMfaScope(t *testing.T) {
+	throttle, db, user := newTestLoginThrottle(t)
+
+	start := time.Now()
+
+	for range 3 {
+		err := throttle.FailMfa(t.Context(), user)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := throttle.CheckMfa(t.Context(), user)
+
+	if !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("expected ErrLoginLocked, got %v", err)
+	}
+
+	checkUnlockAt(t, user.UnlockAt, start, DEFAULT_LOGIN_LOCKOUT)
+
+	found, _ := db.FindUserByUuid(t.Context(), user.Uuid)
+
+	if found.UnlockAt != user.UnlockAt {
+		t.Fatal("stored user does not carry the mfa lockout")
+	}
+
+	// the right password does not clear wrong second factors
+	err = throttle.VerifyPassword(t.Context(), user, "", testPassword)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = throttle.CheckMfa(t.Context(), user)
+
+	if !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("password sign in cleared the mfa lockout: %v", err)
+	}
+
+	err = throttle.Unlock(t.Context(), user)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = throttle.CheckMfa(t.Context(), user)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// password lockouts also block second factors
+	for range 3 {
+		throttle.Fail(t.Context(), user, "")
+	}
+
+	err = throttle.CheckMfa(t.Context(), user)
+
+	if !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("expected ErrLoginLocked, got %v", err)
+	}
+}
+
+func TestLoginThrottleDisabled(t *testing.T) {
+	throttle, _, user := newTestLoginThrottle(t)
+
+	throttle.SetMaxFailures(0).SetMaxIpFailures(0)
+
+	for range 10 {
+		throttle.Fail(t.Context(), user, "192.0.2.1")
+	}
+
+	err := throttle.Check(t.Context(), user, "192.0.2.1")
+
+	if err != nil {
+		t.Fatalf("locked with lockouts turned off: %v", err)
+	}
+
+	failures, _ := throttle.UserFailures(t.Context(), user)
+
+	if failures.Failures != 10 {
+		t.Fatalf("%d failures", failures.Failures)
+	}
+}
@@ -0,0 +1,1852 @@
+package auth
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// In-memory user store for tests and local development. It follows
+// the same rules as UserDb, but nothing is persisted. Lookups of
+// missing users return sql.ErrNoRows so callers see the same errors
+// regardless of which store they are using.
+type MemUserDb struct {
+	users           map[uint]*AuthUser
+	roles           map[uint]*Role
+	permissions     map[uint]*Permission
+	userRoles       map[uint]map[uint]struct{}
+	rolePermissions map[uint]map[uint]struct{}
+	// api key to user id
+	apiKeys       map[string]uint
+	refreshTokens map[string]*RefreshTokenRecord
+	// revoked token id to when the token expires
+	revokedTokens map[string]int64
+	// consumed one time token id to when the token expires
+	consumedTokens map[string]int64
+	totp           map[uint]*TotpRecord
+	// user id to recovery code hashes
+	recoveryCodes map[uint]map[string]struct{}
+	// credential id to passkey
+	webAuthnCredentials map[string]*WebAuthnCredential
+	// challenge id to outstanding challenge
+	webAuthnChallenges map[string]*WebAuthnChallenge
+	// user id to previous password hashes, newest first
+	passwordHistory map[uint][]string
+	loginFailures   map[loginFailureKey]*LoginFailures
+	nextId          uint
+	mutex           sync.RWMutex
+}
+
+type loginFailureKey struct {
+	scope   string
+	subject string
+}
+
+// The store passed to fn in WithTx, a copy of the store that
+// replaces it on commit. Nested calls to WithTx join the running
+// transaction.
+type memUserDbTx struct {
+	*MemUserDb
+}
+
+type PermissionFixture struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description" yaml:"description"`
+}
+
+type RoleFixture struct {
+	Name        string   `json:"name" yaml:"name"`
+	Description string   `json:"description" yaml:"description"`
+	Permissions []string `json:"permissions" yaml:"permissions"`
+}
+
+type UserFixture struct {
+	Uuid          string   `json:"uuid" yaml:"uuid"`
+	FirstName     string   `json:"firstName" yaml:"firstName"`
+	LastName      string   `json:"lastName" yaml:"lastName"`
+	Username      string   `json:"username" yaml:"username"`
+	Email         string   `json:"email" yaml:"email"`
+	Password      string   `json:"password" yaml:"password"`
+	Roles         []string `json:"roles" yaml:"roles"`
+	ApiKeys       []string `json:"apiKeys" yaml:"apiKeys"`
+	EmailVerified bool     `json:"emailVerified" yaml:"emailVerified"`
+	IsLocked      bool     `json:"isLocked" yaml:"isLocked"`
+}
+
+// Fixture for seeding a MemUserDb. Roles are created before users
+// so users can refer to them by name.
+type Fixture struct {
+	Permissions []PermissionFixture `json:"permissions" yaml:"permissions"`
+	Roles       []RoleFixture       `json:"roles" yaml:"roles"`
+	Users       []UserFixture       `json:"users" yaml:"users"`
+}
+
+// Create an empty store containing only the built-in roles
+func NewMemUserDB() *MemUserDb {
+	userdb := &MemUserDb{
+		users:               make(map[uint]*AuthUser),
+		roles:               make(map[uint]*Role),
+		permissions:         make(map[uint]*Permission),
+		userRoles:           make(map[uint]map[uint]struct{}),
+		rolePermissions:     make(map[uint]map[uint]struct{}),
+		apiKeys:             make(map[string]uint),
+		refreshTokens:       make(map[string]*RefreshTokenRecord),
+		revokedTokens:       make(map[string]int64),
+		consumedTokens:      make(map[string]int64),
+		totp:                make(map[uint]*TotpRecord),
+		recoveryCodes:       make(map[uint]map[string]struct{}),
+		webAuthnCredentials: make(map[string]*WebAuthnCredential),
+		webAuthnChallenges:  make(map[string]*WebAuthnChallenge),
+		passwordHistory:     make(map[uint][]string),
+		loginFailures:       make(map[loginFailureKey]*LoginFailures),
+	}
+
+	for _, name := range []string{ROLE_SUPER, ROLE_ADMIN, ROLE_USER, ROLE_SIGNIN, ROLE_RDF} {
+		userdb.addRole(name, "")
+	}
+
+	return userdb
+}
+
+// Create a store seeded from a .json, .yaml or .yml fixture file
+func LoadMemUserDB(file string) (*MemUserDb, error) {
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var fixture Fixture
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		err = json.Unmarshal(data, &fixture)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &fixture)
+	default:
+		return nil, fmt.Errorf("fixture must be json or yaml")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	userdb := NewMemUserDB()
+
+	err = userdb.Seed(&fixture)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return userdb, nil
+}
+
+func (userdb *MemUserDb) Seed(fixture *Fixture) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	for _, p := range fixture.Permissions {
+		if userdb.findPermissionByName(p.Name) == nil {
+			userdb.nextId++
+			userdb.permissions[userdb.nextId] = &Permission{Id: userdb.nextId,
+				Uuid:        Uuid(),
+				Name:        p.Name,
+				Description: p.Description}
+		}
+	}
+
+	for _, r := range fixture.Roles {
+		role := userdb.findRoleByName(r.Name)
+
+		if role == nil {
+			role = userdb.addRole(r.Name, r.Description)
+		} else if r.Description != "" {
+			role.Description = r.Description
+		}
+
+		for _, name := range r.Permissions {
+			permission := userdb.findPermissionByName(name)
+
+			if permission == nil {
+				return fmt.Errorf("permission %s does not exist", name)
+			}
+
+			userdb.rolePermissions[role.Id][permission.Id] = struct{}{}
+		}
+	}
+
+	for _, u := range fixture.Users {
+		email, err := mail.ParseAddress(u.Email)
+
+		if err != nil {
+			return err
+		}
+
+		username := u.Username
+
+		if username == "" {
+			username = email.Address
+		}
+
+		user, err := userdb.insertUser(u.Uuid, username, email, u.Password, u.FirstName, u.LastName, u.EmailVerified)
+
+		if err != nil {
+			return err
+		}
+
+		user.IsLocked = u.IsLocked
+
+		for _, name := range u.Roles {
+			role := userdb.findRoleByName(name)
+
+			if role == nil {
+				return fmt.Errorf("role %s does not exist", name)
+			}
+
+			userdb.userRoles[user.Id][role.Id] = struct{}{}
+		}
+
+		for _, key := range u.ApiKeys {
+			userdb.apiKeys[key] = user.Id
+		}
+	}
+
+	return nil
+}
+
+func (userdb *MemUserDb) Close() error {
+	return nil
+}
+
+// fn works on a copy of the store, which replaces the store if fn
+// returns nil and is thrown away otherwise. The store is locked
+// until fn returns, so nothing else can change it, or read it, while
+// the transaction runs. fn must only use the store it is given or it
+// will deadlock.
+func (userdb *MemUserDb) WithTx(ctx context.Context, fn func(tx UserStore) error) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	tx := &memUserDbTx{userdb.clone()}
+
+	err := fn(tx)
+
+	if err != nil {
+		return err
+	}
+
+	userdb.replace(tx.MemUserDb)
+
+	return nil
+}
+
+func (tx *memUserDbTx) WithTx(ctx context.Context, fn func(tx UserStore) error) error {
+	return fn(tx)
+}
+
+func (userdb *MemUserDb) NumUsers(ctx context.Context) (uint, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	return uint(len(userdb.users)), nil
+}
+
+func (userdb *MemUserDb) Users(ctx context.Context, records uint, offset uint, opts ...UserOption) ([]*AuthUser, error) {
+	return userdb.QueryUsers(ctx, &UserQuery{Records: records, Offset: offset}, opts...)
+}
+
+func (userdb *MemUserDb) QueryUsers(ctx context.Context, query *UserQuery, opts ...UserOption) ([]*AuthUser, error) {
+	options := NewUserOptions(false, opts...)
+
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	users, err := userdb.matchUsers(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	start := min(int(query.Offset), len(users))
+	end := min(start+int(pageRecords(query.Records)), len(users))
+
+	authUsers := make([]*AuthUser, 0, end-start)
+
+	for _, user := range users[start:end] {
+		authUsers = append(authUsers, userdb.loadUser(user, options))
+	}
+
+	return authUsers, nil
+}
+
+func (userdb *MemUserDb) UsersPage(ctx context.Context, query *UserQuery, cursor string, opts ...UserOption) (*Page[*AuthUser], error) {
+	options := NewUserOptions(false, opts...)
+
+	after, err := decodeCursor(query.cursorKind(), cursor)
+
+	if err != nil {
+		return nil, err
+	}
+
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	users, err := userdb.matchUsers(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	records := pageRecords(query.Records)
+
+	authUsers := make([]*AuthUser, 0, records+1)
+
+	for _, user := range users {
+		if !isAfterCursor(query.sortValues(user), after, query.Descending) {
+			continue
+		}
+
+		authUsers = append(authUsers, userdb.loadUser(user, options))
+
+		if uint(len(authUsers)) > records {
+			break
+		}
+	}
+
+	return makePage(query.cursorKind(), authUsers, records, query.sortValues)
+}
+
+func (userdb *MemUserDb) CountUsers(ctx context.Context, query *UserQuery) (uint, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	users, err := userdb.matchUsers(query)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return uint(len(users)), nil
+}
+
+func (userdb *MemUserDb) DeleteUser(ctx context.Context, uuid string) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	user := userdb.findUser(func(user *AuthUser) bool { return user.Uuid == uuid })
+
+	if user == nil {
+		return sql.ErrNoRows
+	}
+
+	if strings.Contains(MakeClaim(userdb.roleNames(user.Id)), ROLE_SUPER) {
+		return fmt.Errorf("cannot delete superuser account")
+	}
+
+	delete(userdb.users, user.Id)
+	delete(userdb.userRoles, user.Id)
+
+	for key, id := range userdb.apiKeys {
+		if id == user.Id {
+			delete(userdb.apiKeys, key)
+		}
+	}
+
+	for id, token := range userdb.refreshTokens {
+		if token.UserId == user.Id {
+			delete(userdb.refreshTokens, id)
+		}
+	}
+
+	delete(userdb.totp, user.Id)
+	delete(userdb.recoveryCodes, user.Id)
+	delete(userdb.passwordHistory, user.Id)
+	delete(userdb.loginFailures, loginFailureKey{LOGIN_SCOPE_USER, user.Uuid})
+	delete(userdb.loginFailures, loginFailureKey{LOGIN_SCOPE_MFA, user.Uuid})
+
+	for id, credential := range userdb.webAuthnCredentials {
+		if credential.UserId == user.Id {
+			delete(userdb.webAuthnCredentials, id)
+		}
+	}
+
+	for id, challenge := range userdb.webAuthnChallenges {
+		if challenge.UserId == user.Id {
+			delete(userdb.webAuthnChallenges, id)
+		}
+	}
+
+	return nil
+}
+
+func (userdb *MemUserDb) AddRefreshToken(ctx context.Context, token *RefreshTokenRecord) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	_, ok := userdb.users[token.UserId]
+
+	if !ok {
+		return fmt.Errorf("user does not exist")
+	}
+
+	_, ok = userdb.refreshTokens[token.Id]
+
+	if ok {
+		return fmt.Errorf("refresh token already exists")
+	}
+
+	t := *token
+	t.UsedAt = 0
+	t.RevokedAt = 0
+	userdb.refreshTokens[t.Id] = &t
+
+	return nil
+}
+
+func (userdb *MemUserDb) FindRefreshToken(ctx context.Context, id string) (*RefreshTokenRecord, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	token, ok := userdb.refreshTokens[id]
+
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	t := *token
+
+	return &t, nil
+}
+
+func (userdb *MemUserDb) UseRefreshToken(ctx context.Context, id string, usedAt int64) (bool, error) {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	token, ok := userdb.refreshTokens[id]
+
+	if !ok || token.UsedAt != 0 {
+		return false, nil
+	}
+
+	token.UsedAt = usedAt
+
+	return true, nil
+}
+
+func (userdb *MemUserDb) RevokeRefreshTokenFamily(ctx context.Context, familyId string, revokedAt int64) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	for _, token := range userdb.refreshTokens {
+		if token.FamilyId == familyId && token.RevokedAt == 0 {
+			token.RevokedAt = revokedAt
+		}
+	}
+
+	return nil
+}
+
+func (userdb *MemUserDb) DeleteExpiredRefreshTokens(ctx context.Context, now int64) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	maps.DeleteFunc(userdb.refreshTokens, func(id string, token *RefreshTokenRecord) bool {
+		return token.ExpiresAt < now
+	})
+
+	return nil
+}
+
+func (userdb *MemUserDb) RevokeToken(ctx context.Context, id string, expiresAt int64) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	_, ok := userdb.revokedTokens[id]
+
+	if !ok {
+		userdb.revokedTokens[id] = expiresAt
+	}
+
+	userdb.deleteExpiredRevokedTokens(time.Now().Unix())
+
+	return nil
+}
+
+func (userdb *MemUserDb) IsTokenRevoked(ctx context.Context, id string) (bool, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	_, ok := userdb.revokedTokens[id]
+
+	return ok, nil
+}
+
+func (userdb *MemUserDb) DeleteExpiredRevokedTokens(ctx context.Context, now int64) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	userdb.deleteExpiredRevokedTokens(now)
+
+	return nil
+}
+
+func (userdb *MemUserDb) deleteExpiredRevokedTokens(now int64) {
+	maps.DeleteFunc(userdb.revokedTokens, func(id string, expiresAt int64) bool {
+		return expiresAt < now
+	})
+}
+
+func (userdb *MemUserDb) ConsumeToken(ctx context.Context, id string, tokenType TokenType, expiresAt int64) (bool, error) {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	_, ok := userdb.consumedTokens[id]
+
+	if ok {
+		return false, nil
+	}
+
+	userdb.consumedTokens[id] = expiresAt
+
+	userdb.deleteExpiredConsumedTokens(time.Now().Unix())
+
+	return true, nil
+}
+
+func (userdb *MemUserDb) DeleteExpiredConsumedTokens(ctx context.Context, now int64) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	userdb.deleteExpiredConsumedTokens(now)
+
+	return nil
+}
+
+func (userdb *MemUserDb) deleteExpiredConsumedTokens(now int64) {
+	maps.DeleteFunc(userdb.consumedTokens, func(id string, expiresAt int64) bool {
+		return expiresAt < now
+	})
+}
+
+func (userdb *MemUserDb) SetTotpSecret(ctx context.Context, user *AuthUser, secret string) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	_, ok := userdb.users[user.Id]
+
+	if !ok {
+		return fmt.Errorf("user does not exist")
+	}
+
+	userdb.totp[user.Id] = &TotpRecord{UserId: user.Id,
+		Secret:    secret,
+		CreatedAt: time.Now().Unix()}
+
+	return nil
+}
+
+func (userdb *MemUserDb) FindTotp(ctx context.Context, user *AuthUser) (*TotpRecord, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	totp, ok := userdb.totp[user.Id]
+
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	t := *totp
+
+	return &t, nil
+}
+
+func (userdb *MemUserDb) ConfirmTotp(ctx context.Context, user *AuthUser, step int64) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	totp, ok := userdb.totp[user.Id]
+
+	if ok {
+		totp.ConfirmedAt = time.Now().Unix()
+		totp.LastStep = step
+	}
+
+	return nil
+}
+
+func (userdb *MemUserDb) UseTotpStep(ctx context.Context, user *AuthUser, step int64) (bool, error) {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	totp, ok := userdb.totp[user.Id]
+
+	if !ok || totp.ConfirmedAt == 0 || totp.LastStep >= step {
+		return false, nil
+	}
+
+	totp.LastStep = step
+
+	return true, nil
+}
+
+func (userdb *MemUserDb) DeleteTotp(ctx context.Context, user *AuthUser) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	delete(userdb.totp, user.Id)
+
+	return nil
+}
+
+func (userdb *MemUserDb) SetRecoveryCodes(ctx context.Context, user *AuthUser, hashes []string) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	_, ok := userdb.users[user.Id]
+
+	if !ok {
+		return fmt.Errorf("user does not exist")
+	}
+
+	codes := make(map[string]struct{}, len(hashes))
+
+	for _, hash := range hashes {
+		codes[hash] = struct{}{}
+	}
+
+	userdb.recoveryCodes[user.Id] = codes
+
+	return nil
+}
+
+func (userdb *MemUserDb) UseRecoveryCode(ctx context.Context, user *AuthUser, hash string) (bool, error) {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	codes := userdb.recoveryCodes[user.Id]
+
+	_, ok := codes[hash]
+
+	if !ok {
+		return false, nil
+	}
+
+	delete(codes, hash)
+
+	return true, nil
+}
+
+func (userdb *MemUserDb) CountRecoveryCodes(ctx context.Context, user *AuthUser) (uint, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	return uint(len(userdb.recoveryCodes[user.Id])), nil
+}
+
+func (userdb *MemUserDb) DeleteRecoveryCodes(ctx context.Context, user *AuthUser) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	delete(userdb.recoveryCodes, user.Id)
+
+	return nil
+}
+
+func (userdb *MemUserDb) AddWebAuthnChallenge(ctx context.Context, challenge *WebAuthnChallenge) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	c := *challenge
+	userdb.webAuthnChallenges[challenge.Id] = &c
+
+	userdb.deleteExpiredWebAuthnChallenges(time.Now().Unix())
+
+	return nil
+}
+
+func (userdb *MemUserDb) ConsumeWebAuthnChallenge(ctx context.Context, id string) (*WebAuthnChallenge, error) {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	challenge, ok := userdb.webAuthnChallenges[id]
+
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	delete(userdb.webAuthnChallenges, id)
+
+	return challenge, nil
+}
+
+func (userdb *MemUserDb) DeleteExpiredWebAuthnChallenges(ctx context.Context, now int64) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	userdb.deleteExpiredWebAuthnChallenges(now)
+
+	return nil
+}
+
+func (userdb *MemUserDb) deleteExpiredWebAuthnChallenges(now int64) {
+	for id, challenge := range userdb.webAuthnChallenges {
+		if challenge.ExpiresAt < now {
+			delete(userdb.webAuthnChallenges, id)
+		}
+	}
+}
+
+func (userdb *MemUserDb) AddWebAuthnCredential(ctx context.Context, credential *WebAuthnCredential) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	_, ok := userdb.users[credential.UserId]
+
+	if !ok {
+		return fmt.Errorf("user does not exist")
+	}
+
+	_, ok = userdb.webAuthnCredentials[credential.Id]
+
+	if ok {
+		return fmt.Errorf("credential already exists")
+	}
+
+	c := *credential
+	userdb.webAuthnCredentials[credential.Id] = &c
+
+	return nil
+}
+
+func (userdb *MemUserDb) FindWebAuthnCredential(ctx context.Context, id string) (*WebAuthnCredential, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	credential, ok := userdb.webAuthnCredentials[id]
+
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	c := *credential
+
+	return &c, nil
+}
+
+func (userdb *MemUserDb) UserWebAuthnCredentials(ctx context.Context, user *AuthUser) ([]*WebAuthnCredential, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	credentials := make([]*WebAuthnCredential, 0, 4)
+
+	for _, credential := range userdb.webAuthnCredentials {
+		if credential.UserId == user.Id {
+			c := *credential
+			credentials = append(credentials, &c)
+		}
+	}
+
+	// same order as the sql store
+	slices.SortFunc(credentials, func(a, b *WebAuthnCredential) int {
+		return cmp.Or(cmp.Compare(a.CreatedAt, b.CreatedAt), cmp.Compare(a.Id, b.Id))
+	})
+
+	return credentials, nil
+}
+
+func (userdb *MemUserDb) UseWebAuthnCredential(ctx context.Context, id string, signCount uint32, usedAt int64) (bool, error) {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	credential, ok := userdb.webAuthnCredentials[id]
+
+	if !ok {
+		return false, nil
+	}
+
+	if !webAuthnSignCountOk(credential.SignCount, signCount) {
+		return false, nil
+	}
+
+	credential.SignCount = signCount
+	credential.LastUsedAt = usedAt
+
+	return true, nil
+}
+
+func (userdb *MemUserDb) DeleteWebAuthnCredential(ctx context.Context, user *AuthUser, id string) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	credential, ok := userdb.webAuthnCredentials[id]
+
+	if ok && credential.UserId == user.Id {
+		delete(userdb.webAuthnCredentials, id)
+	}
+
+	return nil
+}
+
+func (userdb *MemUserDb) AddLoginFailure(ctx context.Context, scope string, subject string, failedAt int64, resetBefore int64) (uint, error) {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	key := loginFailureKey{scope, subject}
+
+	failures, ok := userdb.loginFailures[key]
+
+	if !ok {
+		failures = &LoginFailures{Scope: scope, Subject: subject}
+		userdb.loginFailures[key] = failures
+	}
+
+	// the count starts again if the last failure was too long ago
+	if failures.LastFailedAt < resetBefore {
+		failures.Failures = 0
+	}
+
+	failures.Failures++
+	failures.LastFailedAt = failedAt
+
+	return failures.Failures, nil
+}
+
+func (userdb *MemUserDb) SetLoginUnlockAt(ctx context.Context, scope string, subject string, unlockAt int64) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	if failures, ok := userdb.loginFailures[loginFailureKey{scope, subject}]; ok {
+		failures.UnlockAt = unlockAt
+	}
+
+	return nil
+}
+
+func (userdb *MemUserDb) FindLoginFailures(ctx context.Context, scope string, subject string) (*LoginFailures, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	failures, ok := userdb.loginFailures[loginFailureKey{scope, subject}]
+
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	f := *failures
+
+	return &f, nil
+}
+
+func (userdb *MemUserDb) LockedLogins(ctx context.Context, now int64) ([]*LoginFailures, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	locked := make([]*LoginFailures, 0, 10)
+
+	for _, failures := range userdb.loginFailures {
+		if failures.UnlockAt > now {
+			f := *failures
+			locked = append(locked, &f)
+		}
+	}
+
+	// same order as the sql store
+	slices.SortFunc(locked, func(a, b *LoginFailures) int {
+		return cmp.Or(cmp.Compare(a.UnlockAt, b.UnlockAt),
+			cmp.Compare(a.Scope, b.Scope),
+			cmp.Compare(a.Subject, b.Subject))
+	})
+
+	return locked, nil
+}
+
+func (userdb *MemUserDb) ClearLoginFailures(ctx context.Context, scope string, subject string) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	delete(userdb.loginFailures, loginFailureKey{scope, subject})
+
+	return nil
+}
+
+func (userdb *MemUserDb) DeleteExpiredLoginFailures(ctx context.Context, before int64) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	for key, failures := range userdb.loginFailures {
+		if failures.LastFailedAt < before && failures.UnlockAt < before {
+			delete(userdb.loginFailures, key)
+		}
+	}
+
+	return nil
+}
+
+func (userdb *MemUserDb) FindUserByEmail(ctx context.Context, email *mail.Address, opts ...UserOption) (*AuthUser, error) {
+	return userdb.lockedFindUser(opts, func(user *AuthUser) bool { return user.Email == email.Address })
+}
+
+func (userdb *MemUserDb) FindUserByUsername(ctx context.Context, username string, opts ...UserOption) (*AuthUser, error) {
+	if strings.Contains(username, "@") {
+		email, err := mail.ParseAddress(username)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return userdb.FindUserByEmail(ctx, email, opts...)
+	}
+
+	err := CheckUsername(username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return userdb.lockedFindUser(opts, func(user *AuthUser) bool { return user.Username == username })
+}
+
+func (userdb *MemUserDb) FindUserById(ctx context.Context, id uint, opts ...UserOption) (*AuthUser, error) {
+	return userdb.lockedFindUser(opts, func(user *AuthUser) bool { return user.Id == id })
+}
+
+func (userdb *MemUserDb) FindUserByUuid(ctx context.Context, uuid string, opts ...UserOption) (*AuthUser, error) {
+	return userdb.lockedFindUser(opts, func(user *AuthUser) bool { return user.Uuid == uuid })
+}
+
+func (userdb *MemUserDb) FindUserByApiKey(ctx context.Context, key string, opts ...UserOption) (*AuthUser, error) {
+	if !IsValidUUID(key) {
+		return nil, fmt.Errorf("api key is not in valid format")
+	}
+
+	userdb.mutex.RLock()
+	id, ok := userdb.apiKeys[key]
+	userdb.mutex.RUnlock()
+
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return userdb.FindUserById(ctx, id, opts...)
+}
+
+func (userdb *MemUserDb) AddRolesToUser(ctx context.Context, authUser *AuthUser) error {
+	roles, err := userdb.UserRoleList(ctx, authUser)
+
+	if err != nil {
+		return err
+	}
+
+	authUser.Roles = roles
+
+	return nil
+}
+
+func (userdb *MemUserDb) UserRoleList(ctx context.Context, user *AuthUser) ([]string, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	return userdb.roleNames(user.Id), nil
+}
+
+func (userdb *MemUserDb) AddApiKeysToUser(ctx context.Context, authUser *AuthUser) error {
+	keys, err := userdb.UserApiKeys(ctx, authUser)
+
+	if err != nil {
+		return err
+	}
+
+	authUser.ApiKeys = keys
+
+	return nil
+}
+
+func (userdb *MemUserDb) UserApiKeys(ctx context.Context, user *AuthUser) ([]string, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	return userdb.userApiKeys(user.Id), nil
+}
+
+func (userdb *MemUserDb) UserRoles(ctx context.Context, user *AuthUser) ([]*Role, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	return userdb.userRoleList(user.Id), nil
+}
+
+func (userdb *MemUserDb) PermissionList(ctx context.Context, user *AuthUser) ([]string, error) {
+	permissions, err := userdb.UserPermissions(ctx, user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, len(permissions))
+
+	for pi, permission := range permissions {
+		ret[pi] = permission.Name
+	}
+
+	return ret, nil
+}
+
+func (userdb *MemUserDb) UserPermissions(ctx context.Context, user *AuthUser) ([]*Permission, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	permissionIds := make(map[uint]struct{})
+
+	for roleId := range userdb.userRoles[user.Id] {
+		for permissionId := range userdb.rolePermissions[roleId] {
+			permissionIds[permissionId] = struct{}{}
+		}
+	}
+
+	permissions := make([]*Permission, 0, len(permissionIds))
+
+	for id := range permissionIds {
+		permission := *userdb.permissions[id]
+		permissions = append(permissions, &permission)
+	}
+
+	slices.SortFunc(permissions, func(a, b *Permission) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return permissions, nil
+}
+
+func (userdb *MemUserDb) Roles(ctx context.Context) ([]*Role, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	roles := make([]*Role, 0, len(userdb.roles))
+
+	for _, r := range userdb.roles {
+		role := *r
+		roles = append(roles, &role)
+	}
+
+	sortRoles(roles)
+
+	return roles, nil
+}
+
+func (userdb *MemUserDb) RolesPage(ctx context.Context, records uint, cursor string) (*Page[*Role], error) {
+	after, err := decodeCursor(ROLES_CURSOR, cursor)
+
+	if err != nil {
+		return nil, err
+	}
+
+	allRoles, err := userdb.Roles(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortStableFunc(allRoles, func(a, b *Role) int {
+		return compareSortValues(roleSortValues(a), roleSortValues(b))
+	})
+
+	records = pageRecords(records)
+
+	roles := make([]*Role, 0, records+1)
+
+	for _, role := range allRoles {
+		if isAfterCursor(roleSortValues(role), after, false) {
+			roles = append(roles, role)
+
+			if uint(len(roles)) > records {
+				break
+			}
+		}
+	}
+
+	return makePage(ROLES_CURSOR, roles, records, roleSortValues)
+}
+
+func (userdb *MemUserDb) UserApiKeysPage(ctx context.Context, user *AuthUser, records uint, cursor string) (*Page[string], error) {
+	after, err := decodeCursor(API_KEYS_CURSOR, cursor)
+
+	if err != nil {
+		return nil, err
+	}
+
+	allKeys, err := userdb.UserApiKeys(ctx, user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	records = pageRecords(records)
+
+	keys := make([]string, 0, records+1)
+
+	for _, key := range allKeys {
+		if isAfterCursor(apiKeySortValues(key), after, false) {
+			keys = append(keys, key)
+
+			if uint(len(keys)) > records {
+				break
+			}
+		}
+	}
+
+	return makePage(API_KEYS_CURSOR, keys, records, apiKeySortValues)
+}
+
+func (userdb *MemUserDb) FindRoleByName(ctx context.Context, name string) (*Role, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	role := userdb.findRoleByName(name)
+
+	if role == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	ret := *role
+
+	return &ret, nil
+}
+
+func (userdb *MemUserDb) SetIsVerified(ctx context.Context, userId string) error {
+	return userdb.updateUser(userId, func(user *AuthUser) error {
+		user.EmailVerifiedAt = secondsNow()
+		return nil
+	})
+}
+
+func (userdb *MemUserDb) VerifyPassword(ctx context.Context, user *AuthUser, password string) error {
+	needsRehash, err := user.CheckPasswordsMatch(password)
+
+	if err != nil {
+		return err
+	}
+
+	if !needsRehash {
+		return nil
+	}
+
+	hash, err := HashPassword(password)
+
+	if err != nil {
+		log.Warn().Msgf("could not rehash password for %s: %s", user.Uuid, err)
+		return nil
+	}
+
+	oldHash := user.HashedPassword
+
+	err = userdb.updateUser(user.Uuid, func(stored *AuthUser) error {
+		if stored.HashedPassword == oldHash {
+			stored.HashedPassword = hash
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Warn().Msgf("could not rehash password for %s: %s", user.Uuid, err)
+		return nil
+	}
+
+	user.HashedPassword = hash
+
+	return nil
+}
+
+func (userdb *MemUserDb) SetPassword(ctx context.Context, user *AuthUser, password string) error {
+	return userdb.setPassword(ctx, user, password, true)
+}
+
+func (userdb *MemUserDb) setPassword(ctx context.Context, user *AuthUser, password string, checkReuse bool) error {
+	if user.IsLocked {
+		return fmt.Errorf("account is locked and cannot be edited")
+	}
+
+	err := CheckPassword(password, user)
+
+	if err != nil {
+		return err
+	}
+
+	n := passwordPolicy.PasswordHistory
+
+	if checkReuse && password != "" && n > 0 {
+		err = checkPasswordReuse(password, userdb.recentPasswords(user.Uuid, n))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	hash, err := HashPassword(password)
+
+	if err != nil {
+		return err
+	}
+
+	return userdb.updateUser(user.Uuid, func(stored *AuthUser) error {
+		if n > 0 && stored.HashedPassword != "" {
+			history := append([]string{stored.HashedPassword}, userdb.passwordHistory[stored.Id]...)
+			userdb.passwordHistory[stored.Id] = history[:min(len(history), n)]
+		}
+
+		stored.HashedPassword = hash
+
+		return nil
+	})
+}
+
+// The current password hash and the last n before it
+func (userdb *MemUserDb) recentPasswords(uuid string, n int) []string {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	user := userdb.findUser(func(user *AuthUser) bool { return user.Uuid == uuid })
+
+	if user == nil {
+		return nil
+	}
+
+	history := userdb.passwordHistory[user.Id]
+
+	return append([]string{user.HashedPassword}, history[:min(len(history), n)]...)
+}
+
+func (userdb *MemUserDb) SetUserInfo(ctx context.Context, user *AuthUser,
+	username string,
+	firstName string,
+	lastName string,
+	adminMode bool) error {
+
+	if !adminMode && user.IsLocked {
+		return fmt.Errorf("account is locked and cannot be edited")
+	}
+
+	err := CheckUsername(username)
+
+	if err != nil {
+		return err
+	}
+
+	err = CheckName(firstName)
+
+	if err != nil {
+		return err
+	}
+
+	return userdb.updateUser(user.Uuid, func(u *AuthUser) error {
+		if userdb.findUser(func(other *AuthUser) bool {
+			return other.Id != u.Id && other.Username == username
+		}) != nil {
+			return fmt.Errorf("could not update user info")
+		}
+
+		u.Username = username
+		u.FirstName = firstName
+		u.LastName = lastName
+		return nil
+	})
+}
+
+func (userdb *MemUserDb) SetEmailAddress(ctx context.Context, user *AuthUser, address *mail.Address, adminMode bool) error {
+	if !adminMode && user.IsLocked {
+		return fmt.Errorf("account is locked and cannot be edited")
+	}
+
+	return userdb.updateUser(user.Uuid, func(u *AuthUser) error {
+		if userdb.findUser(func(other *AuthUser) bool {
+			return other.Id != u.Id && other.Email == address.Address
+		}) != nil {
+			return fmt.Errorf("could not update email address")
+		}
+
+		u.Email = address.Address
+		return nil
+	})
+}
+
+func (userdb *MemUserDb) SetUserRoles(ctx context.Context, user *AuthUser, roles []string, adminMode bool) error {
+	if !adminMode && user.IsLocked {
+		return fmt.Errorf("account is locked and cannot be edited")
+	}
+
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	roleIds := make(map[uint]struct{})
+
+	for _, name := range roles {
+		role := userdb.findRoleByName(name)
+
+		if role == nil {
+			return sql.ErrNoRows
+		}
+
+		roleIds[role.Id] = struct{}{}
+	}
+
+	if _, ok := userdb.users[user.Id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	userdb.userRoles[user.Id] = roleIds
+
+	return nil
+}
+
+func (userdb *MemUserDb) AddRoleToUser(ctx context.Context, user *AuthUser, roleName string, adminMode bool) error {
+	if !adminMode && user.IsLocked {
+		return fmt.Errorf("account is locked and cannot be edited")
+	}
+
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	role := userdb.findRoleByName(roleName)
+
+	if role == nil {
+		return sql.ErrNoRows
+	}
+
+	roleIds, ok := userdb.userRoles[user.Id]
+
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	roleIds[role.Id] = struct{}{}
+
+	return nil
+}
+
+func (userdb *MemUserDb) CreateApiKeyForUser(ctx context.Context, user *AuthUser, adminMode bool) error {
+	if !adminMode && user.IsLocked {
+		return fmt.Errorf("account is locked and cannot be edited")
+	}
+
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	if _, ok := userdb.users[user.Id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	userdb.apiKeys[Uuid()] = user.Id
+
+	return nil
+}
+
+func (userdb *MemUserDb) CreateUserFromSignup(ctx context.Context, user *LoginBodyReq) (*AuthUser, error) {
+	email, err := mail.ParseAddress(user.Email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The default username is email address unless a username is provided
+	userName := email.Address
+
+	if user.Username != "" {
+		userName = user.Username
+	}
+
+	// assume email is not verified
+	return userdb.CreateUser(ctx, userName, email, user.Password, user.FirstName, user.LastName, false)
+}
+
+func (userdb *MemUserDb) CreateUserFromAuth0(ctx context.Context, name string, email *mail.Address) (*AuthUser, error) {
+	authUser, err := userdb.FindUserByEmail(ctx, email)
+
+	if err == nil {
+		return authUser, nil
+	}
+
+	firstName := ""
+	lastName := ""
+
+	if !strings.Contains(name, "@") {
+		tokens := strings.SplitN(name, " ", 2)
+
+		firstName = tokens[0]
+
+		if len(tokens) > 1 {
+			lastName = tokens[1]
+		}
+	}
+
+	// user does not exist so create
+	return userdb.CreateUser(ctx, email.Address, email, "", firstName, lastName, true)
+}
+
+func (userdb *MemUserDb) CreateUser(ctx context.Context, userName string,
+	email *mail.Address,
+	password string,
+	firstName string,
+	lastName string,
+	emailIsVerified bool) (*AuthUser, error) {
+	err := CheckPassword(password, &AuthUser{Username: userName,
+		Email:     email.Address,
+		FirstName: firstName,
+		LastName:  lastName})
+
+	if err != nil {
+		return nil, err
+	}
+
+	authUser, _ := userdb.FindUserByEmail(ctx, email)
+
+	if authUser != nil {
+		if authUser.EmailVerifiedAt > EMAIL_NOT_VERIFIED_TIME_S {
+			return nil, fmt.Errorf("user already registered: please sign up with a different email address")
+		}
+
+		// unverified users can keep trying to sign up, see UserDb.CreateUser
+		err := userdb.setPassword(ctx, authUser, password, false)
+
+		if err != nil {
+			return nil, fmt.Errorf("user already registered: please sign up with another email address")
+		}
+
+		return userdb.FindUserById(ctx, authUser.Id)
+	}
+
+	userdb.mutex.Lock()
+
+	user, err := userdb.insertUser("", userName, email, password, firstName, lastName, emailIsVerified)
+
+	if err == nil {
+		for _, name := range []string{ROLE_USER, ROLE_SIGNIN} {
+			userdb.userRoles[user.Id][userdb.findRoleByName(name).Id] = struct{}{}
+		}
+
+		userdb.apiKeys[Uuid()] = user.Id
+	}
+
+	userdb.mutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return userdb.FindUserById(ctx, user.Id)
+}
+
+// Internal functions assume the caller holds the mutex
+
+// users matching a query in sorted order
+func (userdb *MemUserDb) matchUsers(query *UserQuery) ([]*AuthUser, error) {
+	compare, err := compareUsers(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	search := strings.ToLower(strings.TrimSpace(query.Search))
+
+	users := make([]*AuthUser, 0, len(userdb.users))
+
+	for _, user := range userdb.users {
+		if search != "" &&
+			!strings.Contains(strings.ToLower(user.FirstName), search) &&
+			!strings.Contains(strings.ToLower(user.LastName), search) &&
+			!strings.Contains(strings.ToLower(user.Username), search) &&
+			!strings.Contains(strings.ToLower(user.Email), search) {
+			continue
+		}
+
+		if query.Role != "" && !slices.Contains(userdb.roleNames(user.Id), query.Role) {
+			continue
+		}
+
+		if query.IsLocked != nil && user.IsLocked != *query.IsLocked {
+			continue
+		}
+
+		if query.EmailVerified != nil && (user.EmailVerifiedAt > EMAIL_NOT_VERIFIED_TIME_S) != *query.EmailVerified {
+			continue
+		}
+
+		users = append(users, user)
+	}
+
+	slices.SortFunc(users, compare)
+
+	return users, nil
+}
+
+func (userdb *MemUserDb) insertUser(uuid string,
+	userName string,
+	email *mail.Address,
+	password string,
+	firstName string,
+	lastName string,
+	emailIsVerified bool) (*AuthUser, error) {
+
+	// mirror the unique keys on the users table
+	if userdb.findUser(func(user *AuthUser) bool {
+		return user.Username == userName || user.Email == email.Address
+	}) != nil {
+		return nil, fmt.Errorf("user already exists")
+	}
+
+	if uuid == "" {
+		uuid = NanoId()
+	}
+
+	hash := ""
+
+	// empty passwords indicate passwordless
+	if password != "" {
+		var err error
+
+		hash, err = HashPassword(password)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now := secondsNow()
+
+	emailVerifiedAt := EMAIL_NOT_VERIFIED_TIME_S
+
+	if emailIsVerified {
+		emailVerifiedAt = now
+	}
+
+	userdb.nextId++
+
+	user := &AuthUser{Id: userdb.nextId,
+		Uuid:            uuid,
+		FirstName:       firstName,
+		LastName:        lastName,
+		Username:        userName,
+		Email:           email.Address,
+		HashedPassword:  hash,
+		EmailVerifiedAt: emailVerifiedAt,
+		CreatedAt:       now,
+		UpdatedAt:       now}
+
+	userdb.users[user.Id] = user
+	userdb.userRoles[user.Id] = make(map[uint]struct{})
+
+	return user, nil
+}
+
+func (userdb *MemUserDb) addRole(name string, description string) *Role {
+	userdb.nextId++
+
+	role := &Role{Id: userdb.nextId, Uuid: Uuid(), Name: name, Description: description}
+
+	userdb.roles[role.Id] = role
+	userdb.rolePermissions[role.Id] = make(map[uint]struct{})
+
+	return role
+}
+
+func (userdb *MemUserDb) lockedFindUser(opts []UserOption, match func(user *AuthUser) bool) (*AuthUser, error) {
+	userdb.mutex.RLock()
+	defer userdb.mutex.RUnlock()
+
+	user := userdb.findUser(match)
+
+	if user == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	return userdb.loadUser(user, NewUserOptions(true, opts...)), nil
+}
+
+// copy of a user with their roles and optionally api keys
+func (userdb *MemUserDb) loadUser(user *AuthUser, options *UserOptions) *AuthUser {
+	authUser := *user
+	authUser.Roles = userdb.roleNames(user.Id)
+	authUser.ApiKeys = nil
+
+	totp, ok := userdb.totp[user.Id]
+	authUser.MfaEnabled = ok && totp.ConfirmedAt != 0
+
+	// a passkey also counts as a second factor
+	for _, credential := range userdb.webAuthnCredentials {
+		if credential.UserId == user.Id {
+			authUser.MfaEnabled = true
+			break
+		}
+	}
+
+	authUser.RecoveryCodes = uint(len(userdb.recoveryCodes[user.Id]))
+	authUser.UnlockAt = 0
+
+	for _, scope := range []string{LOGIN_SCOPE_USER, LOGIN_SCOPE_MFA} {
+		if failures, ok := userdb.loginFailures[loginFailureKey{scope, user.Uuid}]; ok && failures.UnlockAt > time.Now().Unix() {
+			authUser.UnlockAt = max(authUser.UnlockAt, failures.UnlockAt)
+		}
+	}
+
+	if options.ApiKeys {
+		authUser.ApiKeys = userdb.userApiKeys(user.Id)
+	}
+
+	return &authUser
+}
+
+func (userdb *MemUserDb) findUser(match func(user *AuthUser) bool) *AuthUser {
+	for _, user := range userdb.users {
+		if match(user) {
+			return user
+		}
+	}
+
+	return nil
+}
+
+func (userdb *MemUserDb) updateUser(uuid string, update func(user *AuthUser) error) error {
+	userdb.mutex.Lock()
+	defer userdb.mutex.Unlock()
+
+	user := userdb.findUser(func(user *AuthUser) bool { return user.Uuid == uuid })
+
+	if user == nil {
+		return sql.ErrNoRows
+	}
+
+	err := update(user)
+
+	if err != nil {
+		return err
+	}
+
+	user.UpdatedAt = secondsNow()
+
+	return nil
+}
+
+func (userdb *MemUserDb) findRoleByName(name string) *Role {
+	for _, role := range userdb.roles {
+		if role.Name == name {
+			return role
+		}
+	}
+
+	return nil
+}
+
+func (userdb *MemUserDb) findPermissionByName(name string) *Permission {
+	for _, permission := range userdb.permissions {
+		if permission.Name == name {
+			return permission
+		}
+	}
+
+	return nil
+}
+
+func (userdb *MemUserDb) userRoleList(userId uint) []*Role {
+	roles := make([]*Role, 0, len(userdb.userRoles[userId]))
+
+	for roleId := range userdb.userRoles[userId] {
+		role := *userdb.roles[roleId]
+		roles = append(roles, &role)
+	}
+
+	sortRoles(roles)
+
+	return roles
+}
+
+func (userdb *MemUserDb) roleNames(userId uint) []string {
+	roles := userdb.userRoleList(userId)
+
+	ret := make([]string, len(roles))
+
+	for ri, role := range roles {
+		ret[ri] = role.Name
+	}
+
+	return ret
+}
+
+func (userdb *MemUserDb) userApiKeys(userId uint) []string {
+	keys := make([]string, 0, 10)
+
+	for key, id := range userdb.apiKeys {
+		if id == userId {
+			keys = append(keys, key)
+		}
+	}
+
+	slices.Sort(keys)
+
+	return keys
+}
+
+// a deep copy of the store, apart from its lock, for a transaction
+func (userdb *MemUserDb) clone() *MemUserDb {
+	ret := &MemUserDb{
+		users:               make(map[uint]*AuthUser, len(userdb.users)),
+		roles:               make(map[uint]*Role, len(userdb.roles)),
+		permissions:         make(map[uint]*Permission, len(userdb.permissions)),
+		userRoles:           copyIdSets(userdb.userRoles),
+		rolePermissions:     copyIdSets(userdb.rolePermissions),
+		apiKeys:             maps.Clone(userdb.apiKeys),
+		refreshTokens:       make(map[string]*RefreshTokenRecord, len(userdb.refreshTokens)),
+		revokedTokens:       maps.Clone(userdb.revokedTokens),
+		consumedTokens:      maps.Clone(userdb.consumedTokens),
+		totp:                make(map[uint]*TotpRecord, len(userdb.totp)),
+		recoveryCodes:       make(map[uint]map[string]struct{}, len(userdb.recoveryCodes)),
+		webAuthnCredentials: make(map[string]*WebAuthnCredential, len(userdb.webAuthnCredentials)),
+		// challenges are never changed once added
+		webAuthnChallenges: maps.Clone(userdb.webAuthnChallenges),
+		// history slices are replaced, not changed in place
+		passwordHistory: maps.Clone(userdb.passwordHistory),
+		loginFailures:   make(map[loginFailureKey]*LoginFailures, len(userdb.loginFailures)),
+		nextId:          userdb.nextId,
+	}
+
+	for key, failures := range userdb.loginFailures {
+		f := *failures
+		ret.loginFailures[key] = &f
+	}
+
+	for id, token := range userdb.refreshTokens {
+		t := *token
+		ret.refreshTokens[id] = &t
+	}
+
+	for id, totp := range userdb.totp {
+		t := *totp
+		ret.totp[id] = &t
+	}
+
+	for id, hashes := range userdb.recoveryCodes {
+		ret.recoveryCodes[id] = maps.Clone(hashes)
+	}
+
+	for id, credential := range userdb.webAuthnCredentials {
+		c := *credential
+		ret.webAuthnCredentials[id] = &c
+	}
+
+	for id, user := range userdb.users {
+		u := *user
+		ret.users[id] = &u
+	}
+
+	for id, role := range userdb.roles {
+		r := *role
+		ret.roles[id] = &r
+	}
+
+	for id, permission := range userdb.permissions {
+		p := *permission
+		ret.permissions[id] = &p
+	}
+
+	return ret
+}
+
+// take the state of a committed transaction
+func (userdb *MemUserDb) replace(tx *MemUserDb) {
+	userdb.users = tx.users
+	userdb.roles = tx.roles
+	userdb.permissions = tx.permissions
+	userdb.userRoles = tx.userRoles
+	userdb.rolePermissions = tx.rolePermissions
+	userdb.apiKeys = tx.apiKeys
+	userdb.refreshTokens = tx.refreshTokens
+	userdb.revokedTokens = tx.revokedTokens
+	userdb.consumedTokens = tx.consumedTokens
+	userdb.totp = tx.totp
+	userdb.recoveryCodes = tx.recoveryCodes
+	userdb.webAuthnCredentials = tx.webAuthnCredentials
+	userdb.webAuthnChallenges = tx.webAuthnChallenges
+	userdb.passwordHistory = tx.passwordHistory
+	userdb.loginFailures = tx.loginFailures
+	userdb.nextId = tx.nextId
+}
+
+func copyIdSets(sets map[uint]map[uint]struct{}) map[uint]map[uint]struct{} {
+	ret := make(map[uint]map[uint]struct{}, len(sets))
+
+	for id, set := range sets {
+		ret[id] = maps.Clone(set)
+	}
+
+	return ret
+}
+
+// sort users the same way as UserQuery.orderBy
+func compareUsers(query *UserQuery) (func(a, b *AuthUser) int, error) {
+	var compare func(a, b *AuthUser) int
+
+	switch query.SortBy {
+	case SORT_BY_NAME, "":
+		compare = func(a, b *AuthUser) int {
+			if c := strings.Compare(a.FirstName, b.FirstName); c != 0 {
+				return c
+			}
+
+			if c := strings.Compare(a.LastName, b.LastName); c != 0 {
+				return c
+			}
+
+			return strings.Compare(a.Email, b.Email)
+		}
+	case SORT_BY_USERNAME:
+		compare = func(a, b *AuthUser) int { return strings.Compare(a.Username, b.Username) }
+	case SORT_BY_EMAIL:
+		compare = func(a, b *AuthUser) int { return strings.Compare(a.Email, b.Email) }
+	case SORT_BY_CREATED:
+		compare = func(a, b *AuthUser) int { return cmp.Compare(a.CreatedAt, b.CreatedAt) }
+	case SORT_BY_UPDATED:
+		compare = func(a, b *AuthUser) int { return cmp.Compare(a.UpdatedAt, b.UpdatedAt) }
+	default:
+		return nil, fmt.Errorf("cannot sort users by %s", query.SortBy)
+	}
+
+	return func(a, b *AuthUser) int {
+		c := compare(a, b)
+
+		if c == 0 {
+			c = cmp.Compare(a.Id, b.Id)
+		}
+
+		if query.Descending {
+			return -c
+		}
+
+		return c
+	}, nil
+}
+
+func sortRoles(roles []*Role) {
+	slices.SortFunc(roles, func(a, b *Role) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+}
+
+// Current time in seconds since year 0 to match the
+// values the sql stores return for dates
+func secondsNow() time.Duration {
+	return time.Duration(time.Now().Unix()) + EMAIL_NOT_VERIFIED_TIME_S
+}
+
+var _ UserStore = (*MemUserDb)(nil)
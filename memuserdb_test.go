@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"net/mail"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testRecoveryCodeCount(t *testing.T, store UserStore, user *AuthUser) uint {
+	t.Helper()
+
+	n, err := store.CountRecoveryCodes(t.Context(), user)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestMemUserDbWithTx(t *testing.T) {
+	db, user := newTestUser(t)
+
+	errRollback := errors.New("rollback")
+
+	err := db.WithTx(t.Context(), func(tx UserStore) error {
+		err := tx.SetRecoveryCodes(t.Context(), user, []string{"a", "b"})
+
+		if err != nil {
+			return err
+		}
+
+		// reads in the transaction see its writes
+		if testRecoveryCodeCount(t, tx, user) != 2 {
+			t.Error("write not visible in the transaction")
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if testRecoveryCodeCount(t, db, user) != 2 {
+		t.Fatal("commit was lost")
+	}
+
+	err = db.WithTx(t.Context(), func(tx UserStore) error {
+		tx.SetRecoveryCodes(t.Context(), user, []string{"c"})
+
+		// nested transactions join the outer one
+		return tx.WithTx(t.Context(), func(tx UserStore) error {
+			tx.DeleteRecoveryCodes(t.Context(), user)
+
+			return errRollback
+		})
+	})
+
+	if !errors.Is(err, errRollback) {
+		t.Fatal(err)
+	}
+
+	if testRecoveryCodeCount(t, db, user) != 2 {
+		t.Fatal("rolled back transaction was applied")
+	}
+}
+
+// Writes made outside a transaction while it runs are not undone
+// when it rolls back
+func TestMemUserDbWithTxConcurrentWrites(t *testing.T) {
+	db, user := newTestUser(t)
+
+	started := make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		<-started
+
+		err := db.RevokeToken(t.Context(), "outside", time.Now().Add(time.Hour).Unix())
+
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	err := db.WithTx(t.Context(), func(tx UserStore) error {
+		close(started)
+
+		tx.SetRecoveryCodes(t.Context(), user, []string{"a"})
+
+		// give the other write time to arrive
+		time.Sleep(50 * time.Millisecond)
+
+		return errors.New("rollback")
+	})
+
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	wg.Wait()
+
+	revoked, err := db.IsTokenRevoked(t.Context(), "outside")
+
+	if err != nil || !revoked {
+		t.Fatalf("write outside the transaction was lost: %v", err)
+	}
+
+	if testRecoveryCodeCount(t, db, user) != 0 {
+		t.Fatal("rolled back transaction was applied")
+	}
+}
+
+func TestMemUserDbDeleteUser(t *testing.T) {
+	db, user := newTestUser(t)
+
+	expires := time.Now().Add(time.Minute).Unix()
+
+	// one for the user and one for a discoverable login with no user
+	challenges := []*WebAuthnChallenge{
+		{Id: "mine", UserId: user.Id, Ceremony: "login", ExpiresAt: expires},
+		{Id: "anyone", Ceremony: "login", ExpiresAt: expires},
+	}
+
+	for _, challenge := range challenges {
+		err := db.AddWebAuthnChallenge(t.Context(), challenge)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := db.DeleteUser(t.Context(), user.Uuid)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.FindUserByUuid(t.Context(), user.Uuid)
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("user was not deleted: %v", err)
+	}
+
+	_, err = db.ConsumeWebAuthnChallenge(t.Context(), "mine")
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("challenge was not deleted: %v", err)
+	}
+
+	_, err = db.ConsumeWebAuthnChallenge(t.Context(), "anyone")
+
+	if err != nil {
+		t.Fatalf("other challenge was deleted: %v", err)
+	}
+}
+
+// The sql store does the same
+func TestUserDbDeleteUser(t *testing.T) {
+	db := newTestSqliteUserDb(t)
+
+	err := db.Migrate(t.Context())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email, _ := mail.ParseAddress("ann@example.org")
+
+	user, err := db.CreateUser(t.Context(), "ann", email, "", "Ann", "Smith", true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddWebAuthnChallenge(t.Context(), &WebAuthnChallenge{Id: "mine", UserId: user.Id, Ceremony: "login", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.DeleteUser(t.Context(), user.Uuid)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.ConsumeWebAuthnChallenge(t.Context(), "mine")
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("challenge was not deleted: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// where JwtMiddleware puts the claims in the gin context
+const CLAIMS_KEY = "claims"
+
+const DEFAULT_ACCESS_TOKEN_COOKIE = "access_token"
+
+// Codes in the body of 401 responses so clients can tell, for
+// example, when to use their refresh token
+const (
+	AUTH_TOKEN_MISSING    = "token_missing"
+	AUTH_TOKEN_EXPIRED    = "token_expired"
+	AUTH_TOKEN_REVOKED    = "token_revoked"
+	AUTH_TOKEN_WRONG_TYPE = "token_wrong_type"
+	AUTH_TOKEN_INVALID    = "token_invalid"
+	// sent with a 500 when the token could not be checked
+	AUTH_INTERNAL_ERROR = "internal_error"
+)
+
+var ErrTokenMissing = errors.New("token is missing")
+
+// Body of the error responses JwtMiddleware sends
+type AuthErrorResp struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Gin middleware that only lets requests with a valid access token
+// through and stores its claims in the context, see GetClaims. By
+// default the token is read from the Authorization header as a
+// bearer token.
+type JwtMiddleware struct {
+	verifier *TokenVerifier
+	header   bool
+	cookie   string
+}
+
+func NewJwtMiddleware(verifier *TokenVerifier) *JwtMiddleware {
+	return &JwtMiddleware{verifier: verifier, header: true}
+}
+
+// Whether to read the token from the Authorization header
+func (m *JwtMiddleware) SetHeader(header bool) *JwtMiddleware {
+	m.header = header
+	return m
+}
+
+// Also read the token from a cookie, e.g.
+// DEFAULT_ACCESS_TOKEN_COOKIE. The header is used if a request has
+// both. Use "" to stop reading cookies.
+func (m *JwtMiddleware) SetCookie(name string) *JwtMiddleware {
+	m.cookie = name
+	return m
+}
+
+func (m *JwtMiddleware) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := m.token(c)
+
+		if err != nil {
+			AbortWithAuthError(c, err)
+			return
+		}
+
+		claims, err := m.verifier.Verify(c.Request.Context(), token, ACCESS_TOKEN)
+
+		if err != nil {
+			AbortWithAuthError(c, err)
+			return
+		}
+
+		c.Set(CLAIMS_KEY, claims)
+
+		c.Next()
+	}
+}
+
+func (m *JwtMiddleware) token(c *gin.Context) (string, error) {
+	if m.header {
+		header := c.GetHeader("Authorization")
+
+		if header != "" {
+			scheme, token, ok := strings.Cut(header, " ")
+
+			if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+				return "", fmt.Errorf("%w: authorization header must be a bearer token", ErrTokenInvalid)
+			}
+
+			return strings.TrimSpace(token), nil
+		}
+	}
+
+	if m.cookie != "" {
+		token, err := c.Cookie(m.cookie)
+
+		if err == nil && token != "" {
+			return token, nil
+		}
+	}
+
+	return "", ErrTokenMissing
+}
+
+// Stop a request with a 401 and a body describing what was wrong
+// with its token. Errors that are not about the token, e.g. the
+// revocation store being down, are logged and sent as a 500 with the
+// same body so clients only have one shape to handle.
+func AbortWithAuthError(c *gin.Context, err error) {
+	resp := AuthErrorResp{Message: err.Error()}
+
+	switch {
+	case errors.Is(err, ErrTokenMissing):
+		resp.Code = AUTH_TOKEN_MISSING
+	case errors.Is(err, ErrTokenExpired):
+		resp.Code = AUTH_TOKEN_EXPIRED
+	case errors.Is(err, ErrTokenRevoked):
+		resp.Code = AUTH_TOKEN_REVOKED
+	case errors.Is(err, ErrTokenWrongType):
+		resp.Code = AUTH_TOKEN_WRONG_TYPE
+	case errors.Is(err, ErrTokenInvalid),
+		errors.Is(err, ErrTokenInvalidSignature),
+		errors.Is(err, ErrTokenWrongIssuer),
+		errors.Is(err, ErrTokenWrongAudience),
+		errors.Is(err, ErrTokenNotYetValid):
+		// do not tell clients exactly what was wrong
+		resp.Code = AUTH_TOKEN_INVALID
+		resp.Message = ErrTokenInvalid.Error()
+	default:
+		log.Error().Msgf("could not verify token: %s", err)
+
+		// the error may describe our internals so is not sent
+		c.AbortWithStatusJSON(http.StatusInternalServerError,
+			AuthErrorResp{Code: AUTH_INTERNAL_ERROR, Message: "could not verify token"})
+		return
+	}
+
+	// RFC 6750
+	if resp.Code == AUTH_TOKEN_MISSING {
+		c.Header("WWW-Authenticate", "Bearer")
+	} else {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+
+	c.AbortWithStatusJSON(http.StatusUnauthorized, resp)
+}
+
+// The claims JwtMiddleware stored, false if it has not run
+func GetClaims(c *gin.Context) (*TokenClaims, bool) {
+	value, ok := c.Get(CLAIMS_KEY)
+
+	if !ok {
+		return nil, false
+	}
+
+	claims, ok := value.(*TokenClaims)
+
+	return claims, ok
+}
+
+// Like GetClaims but panics if there are no claims, for handlers
+// that are always behind JwtMiddleware
+func MustGetClaims(c *gin.Context) *TokenClaims {
+	claims, ok := GetClaims(c)
+
+	if !ok {
+		panic("no token claims in context, is JwtMiddleware installed?")
+	}
+
+	return claims
+}
+
+// Public id of the signed in user, or "" if there are no claims
+func GetUserId(c *gin.Context) string {
+	claims, ok := GetClaims(c)
+
+	if !ok {
+		return ""
+	}
+
+	return claims.UserId
+}
+
+// Roles of the signed in user from their token
+func GetRoles(c *gin.Context) []string {
+	claims, ok := GetClaims(c)
+
+	if !ok {
+		return nil
+	}
+
+	return strings.Fields(claims.Roles)
+}
+
+// Whether the signed in user's token has a role
+func HasRole(c *gin.Context, role string) bool {
+	return slices.Contains(GetRoles(c), role)
+}
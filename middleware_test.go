@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAbortWithAuthError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{ErrTokenMissing, http.StatusUnauthorized, AUTH_TOKEN_MISSING},
+		{ErrTokenExpired, http.StatusUnauthorized, AUTH_TOKEN_EXPIRED},
+		{ErrTokenRevoked, http.StatusUnauthorized, AUTH_TOKEN_REVOKED},
+		{ErrTokenWrongType, http.StatusUnauthorized, AUTH_TOKEN_WRONG_TYPE},
+		{fmt.Errorf("%w: bad", ErrTokenInvalidSignature), http.StatusUnauthorized, AUTH_TOKEN_INVALID},
+		{errors.New("revocation store: connection refused"), http.StatusInternalServerError, AUTH_INTERNAL_ERROR},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+
+		AbortWithAuthError(c, test.err)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status %d", test.err, w.Code)
+		}
+
+		var resp AuthErrorResp
+
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+
+		if err != nil {
+			t.Errorf("%s: body is not an AuthErrorResp: %s", test.err, err)
+			continue
+		}
+
+		if resp.Code != test.code || resp.Message == "" {
+			t.Errorf("%s: got %+v", test.err, resp)
+		}
+	}
+}
+
+// Internal errors are not passed on to clients
+func TestAbortWithAuthErrorHidesInternalErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	AbortWithAuthError(c, errors.New("dial tcp 10.0.0.5:3306: connection refused"))
+
+	var resp AuthErrorResp
+
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	if resp.Message != "could not verify token" {
+		t.Fatalf("message is %q", resp.Message)
+	}
+
+	if w.Header().Get("WWW-Authenticate") != "" {
+		t.Fatal("500s should not ask for a token")
+	}
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema files are named <version>_<description>.sql and are
+// applied in version order, e.g. migrations/mysql/0001_init.sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+const CREATE_SCHEMA_VERSION_SQL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER NOT NULL PRIMARY KEY,
+	applied_at BIGINT NOT NULL
+)`
+
+const SCHEMA_VERSION_SQL = `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`
+
+const INSERT_SCHEMA_VERSION_SQL = `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`
+
+type migration struct {
+	name    string
+	version int
+}
+
+// Bring the database schema up to date, creating the tables
+// and built-in roles on an empty database
+func (userdb *UserDb) Migrate(ctx context.Context) error {
+	_, err := userdb.db.ExecContext(ctx, CREATE_SCHEMA_VERSION_SQL)
+
+	if err != nil {
+		return err
+	}
+
+	current, err := userdb.SchemaVersion(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	migrations, err := userdb.migrations()
+
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		err = userdb.migrate(ctx, m)
+
+		if err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+	}
+
+	return nil
+}
+
+// The version of the most recent migration applied
+func (userdb *UserDb) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+
+	err := userdb.db.QueryRowContext(ctx, SCHEMA_VERSION_SQL).Scan(&version)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (userdb *UserDb) migrate(ctx context.Context, m *migration) error {
+	data, err := migrationFiles.ReadFile(m.name)
+
+	if err != nil {
+		return err
+	}
+
+	// Postgres and SQLite roll back a failed migration completely.
+	// MySQL commits each CREATE or ALTER as soon as it runs, so the
+	// transaction only covers inserts and the version. Its
+	// migrations are instead written so they can be run again after
+	// failing part way: tables are created IF NOT EXISTS along with
+	// their indexes, rows are added with INSERT IGNORE and a change
+	// to an existing table is a migration of its own with a single
+	// ALTER TABLE.
+	tx, err := userdb.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, stmt := range userdb.dialect.statements(string(data)) {
+		_, err = tx.ExecContext(ctx, stmt)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, userdb.dialect.sql(INSERT_SCHEMA_VERSION_SQL), m.version, time.Now().Unix())
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// list the migrations for our dialect sorted by version
+func (userdb *UserDb) migrations() ([]*migration, error) {
+	dir := path.Join("migrations", userdb.dialect.Name)
+
+	entries, err := fs.ReadDir(migrationFiles, dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]*migration, 0, len(entries))
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+
+		version, err := strconv.Atoi(prefix)
+
+		if err != nil {
+			return nil, fmt.Errorf("migration %s does not start with a version", entry.Name())
+		}
+
+		migrations = append(migrations, &migration{name: path.Join(dir, entry.Name()), version: version})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	return migrations, nil
+}
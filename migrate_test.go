@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestSqliteUserDb(t *testing.T) *UserDb {
+	t.Helper()
+
+	db, err := OpenUserDB(SQLITE_DIALECT, filepath.Join(t.TempDir(), "users.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestMigrateSqlite(t *testing.T) {
+	db := newTestSqliteUserDb(t)
+
+	err := db.Migrate(t.Context())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := db.migrations()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := db.SchemaVersion(t.Context())
+
+	if err != nil || version != migrations[len(migrations)-1].version {
+		t.Fatalf("schema version is %d: %v", version, err)
+	}
+
+	// the keyset sort indexes
+	for _, index := range []string{"users_name_idx", "users_created_at_idx", "users_updated_at_idx"} {
+		var n int
+
+		err = db.Db().QueryRowContext(t.Context(),
+			`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?`, index).Scan(&n)
+
+		if err != nil || n != 1 {
+			t.Errorf("index %s is missing: %v", index, err)
+		}
+	}
+
+	// nothing left to do the second time
+	err = db.Migrate(t.Context())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationsAreNumbered(t *testing.T) {
+	for _, dialect := range []*SqlDialect{MYSQL_DIALECT, POSTGRES_DIALECT, SQLITE_DIALECT} {
+		db := &UserDb{dialect: dialect}
+
+		migrations, err := db.migrations()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for mi, m := range migrations {
+			if m.version != mi+1 {
+				t.Fatalf("%s: %s should be version %d", dialect.Name, m.name, mi+1)
+			}
+		}
+	}
+}
+
+// MySQL cannot roll back ddl so its migrations must be safe to run
+// again, see UserDb.migrate
+func TestMysqlMigrationsCanRerun(t *testing.T) {
+	db := &UserDb{dialect: MYSQL_DIALECT}
+
+	migrations, err := db.migrations()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range migrations {
+		data, err := migrationFiles.ReadFile(m.name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stmts := db.dialect.statements(string(data))
+
+		for _, stmt := range stmts {
+			// drop comments
+			lines := strings.Split(stmt, "\n")
+			lines = slices.DeleteFunc(lines, func(line string) bool { return strings.HasPrefix(line, "--") })
+			stmt = strings.TrimSpace(strings.Join(lines, "\n"))
+
+			switch {
+			case strings.HasPrefix(stmt, "CREATE TABLE IF NOT EXISTS "),
+				strings.HasPrefix(stmt, "INSERT IGNORE INTO "):
+			case strings.HasPrefix(stmt, "ALTER TABLE "):
+				if len(stmts) != 1 {
+					t.Errorf("%s: ALTER TABLE must be the only statement", m.name)
+				}
+			default:
+				t.Errorf("%s: cannot be run again: %.40s", m.name, stmt)
+			}
+		}
+	}
+}
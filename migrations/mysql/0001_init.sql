@@ -0,0 +1,59 @@
+CREATE TABLE IF NOT EXISTS users (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	uuid VARCHAR(64) NOT NULL UNIQUE,
+	username VARCHAR(255) NOT NULL UNIQUE,
+	email VARCHAR(255) NOT NULL UNIQUE,
+	password TEXT NOT NULL,
+	first_name VARCHAR(255) NOT NULL DEFAULT '',
+	last_name VARCHAR(255) NOT NULL DEFAULT '',
+	is_locked BOOLEAN NOT NULL DEFAULT FALSE,
+	email_verified_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00',
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	uuid VARCHAR(64) NOT NULL UNIQUE,
+	name VARCHAR(255) NOT NULL UNIQUE,
+	description TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	uuid VARCHAR(64) NOT NULL UNIQUE,
+	name VARCHAR(255) NOT NULL UNIQUE,
+	description TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+	user_id INT UNSIGNED NOT NULL,
+	role_id INT UNSIGNED NOT NULL,
+	PRIMARY KEY (user_id, role_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+	role_id INT UNSIGNED NOT NULL,
+	permission_id INT UNSIGNED NOT NULL,
+	PRIMARY KEY (role_id, permission_id),
+	FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE,
+	FOREIGN KEY (permission_id) REFERENCES permissions(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id INT UNSIGNED NOT NULL,
+	api_key VARCHAR(64) NOT NULL UNIQUE,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	INDEX api_keys_user_id_idx (user_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+INSERT IGNORE INTO roles (uuid, name, description) VALUES
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a01', 'Super', 'Superuser'),
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a02', 'Admin', 'Administrator'),
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a03', 'User', 'Standard user'),
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a04', 'Signin', 'Can sign in'),
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a05', 'RDF', 'RDF lab member');
@@ -0,0 +1,13 @@
+-- times are unix seconds, used_at and revoked_at are 0 until set
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id VARCHAR(64) NOT NULL PRIMARY KEY,
+	family_id VARCHAR(64) NOT NULL,
+	user_id INT UNSIGNED NOT NULL,
+	created_at BIGINT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	used_at BIGINT NOT NULL DEFAULT 0,
+	revoked_at BIGINT NOT NULL DEFAULT 0,
+	INDEX refresh_tokens_family_id_idx (family_id),
+	INDEX refresh_tokens_expires_at_idx (expires_at),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
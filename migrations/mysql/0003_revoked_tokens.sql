@@ -0,0 +1,9 @@
+-- ids (jti) of tokens revoked before they expire. Rows can be
+-- deleted once expires_at has passed since the token is then
+-- rejected anyway.
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	id VARCHAR(64) NOT NULL PRIMARY KEY,
+	expires_at BIGINT NOT NULL,
+	revoked_at BIGINT NOT NULL,
+	INDEX revoked_tokens_expires_at_idx (expires_at)
+);
@@ -0,0 +1,9 @@
+-- ids (jti) of one time tokens that have been redeemed. Rows can
+-- be deleted once expires_at has passed.
+CREATE TABLE IF NOT EXISTS consumed_tokens (
+	id VARCHAR(64) NOT NULL PRIMARY KEY,
+	token_type VARCHAR(64) NOT NULL,
+	expires_at BIGINT NOT NULL,
+	consumed_at BIGINT NOT NULL,
+	INDEX consumed_tokens_expires_at_idx (expires_at)
+);
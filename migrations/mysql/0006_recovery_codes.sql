@@ -0,0 +1,10 @@
+-- sha256 hashes of unused mfa recovery codes. A code is deleted
+-- when it is used.
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id INT UNSIGNED NOT NULL,
+	code_hash VARCHAR(64) NOT NULL,
+	created_at BIGINT NOT NULL,
+	UNIQUE (user_id, code_hash),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
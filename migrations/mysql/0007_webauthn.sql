@@ -0,0 +1,26 @@
+-- passkeys registered by users. id is the base64url credential id
+-- and public_key the base64url COSE key from the authenticator.
+-- sign_count is the last counter the authenticator reported so
+-- cloned authenticators can be spotted.
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+	id VARCHAR(255) NOT NULL PRIMARY KEY,
+	user_id INT UNSIGNED NOT NULL,
+	public_key TEXT NOT NULL,
+	sign_count BIGINT NOT NULL DEFAULT 0,
+	name VARCHAR(255) NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL,
+	last_used_at BIGINT NOT NULL DEFAULT 0,
+	INDEX webauthn_credentials_user_id_idx (user_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- outstanding registration and sign in challenges. A challenge is
+-- deleted when it is used and rows can be deleted once expires_at
+-- has passed. user_id is 0 for sign ins that do not name a user.
+CREATE TABLE IF NOT EXISTS webauthn_challenges (
+	id VARCHAR(64) NOT NULL PRIMARY KEY,
+	user_id INT UNSIGNED NOT NULL DEFAULT 0,
+	ceremony VARCHAR(64) NOT NULL,
+	expires_at BIGINT NOT NULL,
+	INDEX webauthn_challenges_expires_at_idx (expires_at)
+);
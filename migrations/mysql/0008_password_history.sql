@@ -0,0 +1,10 @@
+-- hashes of passwords users have had before so they cannot be
+-- reused. Only the most recent are kept, see PasswordPolicy.
+CREATE TABLE IF NOT EXISTS user_password_history (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id INT UNSIGNED NOT NULL,
+	password TEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	INDEX user_password_history_user_id_idx (user_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
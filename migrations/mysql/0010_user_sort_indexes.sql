@@ -0,0 +1,8 @@
+-- keyset pagination of users, see UserQuery.sortColumns. Usernames
+-- and emails are already unique so their indexes cover sorting by
+-- them. One statement so the indexes are added together or not at
+-- all, see UserDb.migrate.
+ALTER TABLE users
+	ADD INDEX users_name_idx (first_name, last_name, email, id),
+	ADD INDEX users_created_at_idx (created_at, id),
+	ADD INDEX users_updated_at_idx (updated_at, id);
@@ -0,0 +1,65 @@
+CREATE TABLE users (
+	id SERIAL PRIMARY KEY,
+	uuid VARCHAR(64) NOT NULL UNIQUE,
+	username VARCHAR(255) NOT NULL UNIQUE,
+	email VARCHAR(255) NOT NULL UNIQUE,
+	password TEXT NOT NULL,
+	first_name VARCHAR(255) NOT NULL DEFAULT '',
+	last_name VARCHAR(255) NOT NULL DEFAULT '',
+	is_locked BOOLEAN NOT NULL DEFAULT FALSE,
+	email_verified_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00',
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE FUNCTION set_updated_at() RETURNS TRIGGER AS $$
+BEGIN
+	NEW.updated_at = CURRENT_TIMESTAMP;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_updated_at BEFORE UPDATE ON users
+FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+CREATE TABLE roles (
+	id SERIAL PRIMARY KEY,
+	uuid VARCHAR(64) NOT NULL UNIQUE,
+	name VARCHAR(255) NOT NULL UNIQUE,
+	description TEXT NOT NULL
+);
+
+CREATE TABLE permissions (
+	id SERIAL PRIMARY KEY,
+	uuid VARCHAR(64) NOT NULL UNIQUE,
+	name VARCHAR(255) NOT NULL UNIQUE,
+	description TEXT NOT NULL
+);
+
+CREATE TABLE users_roles (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	PRIMARY KEY (user_id, role_id)
+);
+
+CREATE TABLE roles_permissions (
+	role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	permission_id INTEGER NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+	PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE api_keys (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	api_key VARCHAR(64) NOT NULL UNIQUE,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);
+
+INSERT INTO roles (uuid, name, description) VALUES
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a01', 'Super', 'Superuser'),
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a02', 'Admin', 'Administrator'),
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a03', 'User', 'Standard user'),
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a04', 'Signin', 'Can sign in'),
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a05', 'RDF', 'RDF lab member');
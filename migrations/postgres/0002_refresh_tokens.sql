@@ -0,0 +1,14 @@
+-- times are unix seconds, used_at and revoked_at are 0 until set
+CREATE TABLE refresh_tokens (
+	id VARCHAR(64) NOT NULL PRIMARY KEY,
+	family_id VARCHAR(64) NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created_at BIGINT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	used_at BIGINT NOT NULL DEFAULT 0,
+	revoked_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+CREATE INDEX refresh_tokens_expires_at_idx ON refresh_tokens (expires_at);
@@ -0,0 +1,11 @@
+-- totp secrets are encrypted by the app. confirmed_at is 0 until
+-- the user proves they have set up their authenticator and
+-- last_step is the time step of the last code accepted so codes
+-- cannot be replayed.
+CREATE TABLE user_totp (
+	user_id INTEGER NOT NULL PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	secret VARCHAR(255) NOT NULL,
+	created_at BIGINT NOT NULL,
+	confirmed_at BIGINT NOT NULL DEFAULT 0,
+	last_step BIGINT NOT NULL DEFAULT 0
+);
@@ -0,0 +1,9 @@
+-- sha256 hashes of unused mfa recovery codes. A code is deleted
+-- when it is used.
+CREATE TABLE user_recovery_codes (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code_hash VARCHAR(64) NOT NULL,
+	created_at BIGINT NOT NULL,
+	UNIQUE (user_id, code_hash)
+);
@@ -0,0 +1,27 @@
+-- passkeys registered by users. id is the base64url credential id
+-- and public_key the base64url COSE key from the authenticator.
+-- sign_count is the last counter the authenticator reported so
+-- cloned authenticators can be spotted.
+CREATE TABLE webauthn_credentials (
+	id VARCHAR(255) NOT NULL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	public_key TEXT NOT NULL,
+	sign_count BIGINT NOT NULL DEFAULT 0,
+	name VARCHAR(255) NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL,
+	last_used_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
+
+-- outstanding registration and sign in challenges. A challenge is
+-- deleted when it is used and rows can be deleted once expires_at
+-- has passed. user_id is 0 for sign ins that do not name a user.
+CREATE TABLE webauthn_challenges (
+	id VARCHAR(64) NOT NULL PRIMARY KEY,
+	user_id INTEGER NOT NULL DEFAULT 0,
+	ceremony VARCHAR(64) NOT NULL,
+	expires_at BIGINT NOT NULL
+);
+
+CREATE INDEX webauthn_challenges_expires_at_idx ON webauthn_challenges (expires_at);
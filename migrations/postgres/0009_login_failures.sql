@@ -0,0 +1,15 @@
+-- failed sign ins per account and per ip address. scope is user,
+-- with the user's uuid as subject, or ip. Sign ins are refused
+-- until unlock_at once there have been too many failures, see
+-- LoginThrottle. Rows can be deleted once last_failed_at is old
+-- and unlock_at has passed.
+CREATE TABLE login_failures (
+	scope VARCHAR(16) NOT NULL,
+	subject VARCHAR(255) NOT NULL,
+	failures INTEGER NOT NULL DEFAULT 0,
+	last_failed_at BIGINT NOT NULL,
+	unlock_at BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (scope, subject)
+);
+
+CREATE INDEX login_failures_unlock_at_idx ON login_failures (unlock_at);
@@ -0,0 +1,8 @@
+-- keyset pagination of users, see UserQuery.sortColumns. Usernames
+-- and emails are already unique so their indexes cover sorting by
+-- them.
+CREATE INDEX users_name_idx ON users (first_name, last_name, email, id);
+
+CREATE INDEX users_created_at_idx ON users (created_at, id);
+
+CREATE INDEX users_updated_at_idx ON users (updated_at, id);
@@ -0,0 +1,61 @@
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	uuid TEXT NOT NULL UNIQUE,
+	username TEXT NOT NULL UNIQUE,
+	email TEXT NOT NULL UNIQUE,
+	password TEXT NOT NULL,
+	first_name TEXT NOT NULL DEFAULT '',
+	last_name TEXT NOT NULL DEFAULT '',
+	is_locked BOOLEAN NOT NULL DEFAULT FALSE,
+	email_verified_at TEXT NOT NULL DEFAULT '1970-01-01 00:00:00',
+	created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER users_updated_at AFTER UPDATE ON users
+FOR EACH ROW WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+	UPDATE users SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+
+CREATE TABLE roles (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	uuid TEXT NOT NULL UNIQUE,
+	name TEXT NOT NULL UNIQUE,
+	description TEXT NOT NULL
+);
+
+CREATE TABLE permissions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	uuid TEXT NOT NULL UNIQUE,
+	name TEXT NOT NULL UNIQUE,
+	description TEXT NOT NULL
+);
+
+CREATE TABLE users_roles (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	PRIMARY KEY (user_id, role_id)
+);
+
+CREATE TABLE roles_permissions (
+	role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	permission_id INTEGER NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+	PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE api_keys (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	api_key TEXT NOT NULL UNIQUE,
+	created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);
+
+INSERT INTO roles (uuid, name, description) VALUES
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a01', 'Super', 'Superuser'),
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a02', 'Admin', 'Administrator'),
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a03', 'User', 'Standard user'),
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a04', 'Signin', 'Can sign in'),
+	('5f6bfa02-6d3f-4f4c-9d6b-2b6d0f4b1a05', 'RDF', 'RDF lab member');
@@ -0,0 +1,10 @@
+-- ids (jti) of tokens revoked before they expire. Rows can be
+-- deleted once expires_at has passed since the token is then
+-- rejected anyway.
+CREATE TABLE revoked_tokens (
+	id TEXT NOT NULL PRIMARY KEY,
+	expires_at BIGINT NOT NULL,
+	revoked_at BIGINT NOT NULL
+);
+
+CREATE INDEX revoked_tokens_expires_at_idx ON revoked_tokens (expires_at);
@@ -0,0 +1,10 @@
+-- ids (jti) of one time tokens that have been redeemed. Rows can
+-- be deleted once expires_at has passed.
+CREATE TABLE consumed_tokens (
+	id TEXT NOT NULL PRIMARY KEY,
+	token_type TEXT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	consumed_at BIGINT NOT NULL
+);
+
+CREATE INDEX consumed_tokens_expires_at_idx ON consumed_tokens (expires_at);
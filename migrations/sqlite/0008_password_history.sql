@@ -0,0 +1,10 @@
+-- hashes of passwords users have had before so they cannot be
+-- reused. Only the most recent are kept, see PasswordPolicy.
+CREATE TABLE user_password_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	password TEXT NOT NULL,
+	created_at BIGINT NOT NULL
+);
+
+CREATE INDEX user_password_history_user_id_idx ON user_password_history (user_id);
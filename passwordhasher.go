@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// OWASP recommended settings for argon2id
+const (
+	DEFAULT_ARGON2_MEMORY_KIB  = 19 * 1024
+	DEFAULT_ARGON2_ITERATIONS  = 2
+	DEFAULT_ARGON2_PARALLELISM = 1
+	ARGON2_SALT_BYTES          = 16
+	ARGON2_KEY_BYTES           = 32
+)
+
+// bcrypt ignores anything after this
+const BCRYPT_MAX_PASSWORD_BYTES = 72
+
+var ErrPasswordsDoNotMatch = errors.New("passwords do not match")
+
+// Makes password hashes. Hashes from any supported hasher can be
+// checked with CheckPasswordsMatch, so the hasher can be changed at
+// any time and existing hashes are upgraded as users sign in.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// True if hash was not made by this hasher with its current
+	// settings and should be replaced
+	NeedsRehash(hash string) bool
+}
+
+// Hashers that can only hash passwords up to a certain length, such
+// as bcrypt, implement this so PasswordPolicy rejects longer ones
+type MaxPasswordBytesHasher interface {
+	MaxPasswordBytes() int
+}
+
+var passwordHasher PasswordHasher = NewArgon2idHasher()
+
+// Change the hasher used for new passwords, e.g. to bcrypt for
+// compatibility with other apps using the same database
+func SetPasswordHasher(hasher PasswordHasher) {
+	passwordHasher = hasher
+}
+
+// Hashes in the PHC string format, e.g.
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+type Argon2idHasher struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{memory: DEFAULT_ARGON2_MEMORY_KIB,
+		iterations:  DEFAULT_ARGON2_ITERATIONS,
+		parallelism: DEFAULT_ARGON2_PARALLELISM}
+}
+
+// Memory to use in KiB
+func (h *Argon2idHasher) SetMemory(kib uint32) *Argon2idHasher {
+	h.memory = kib
+	return h
+}
+
+func (h *Argon2idHasher) SetIterations(iterations uint32) *Argon2idHasher {
+	h.iterations = iterations
+	return h
+}
+
+func (h *Argon2idHasher) SetParallelism(threads uint8) *Argon2idHasher {
+	h.parallelism = threads
+	return h
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, ARGON2_SALT_BYTES)
+
+	_, err := rand.Read(salt)
+
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.iterations, h.memory, h.parallelism, ARGON2_KEY_BYTES)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.memory,
+		h.iterations,
+		h.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash string) bool {
+	params, _, _, err := parseArgon2idHash(hash)
+
+	if err != nil {
+		return true
+	}
+
+	return params.memory != h.memory ||
+		params.iterations != h.iterations ||
+		params.parallelism != h.parallelism
+}
+
+// Bcrypt only uses the first 72 bytes of a password, so longer
+// passwords are rejected rather than silently truncated. While it is
+// the hasher, PasswordPolicy also rejects them so users are told
+// before their password is hashed.
+type BcryptHasher struct {
+	cost int
+}
+
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{cost: cost}
+}
+
+func (h *BcryptHasher) MaxPasswordBytes() int {
+	return BCRYPT_MAX_PASSWORD_BYTES
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	if len(password) > BCRYPT_MAX_PASSWORD_BYTES {
+		return "", &PasswordPolicyError{Violations: []PasswordViolation{passwordTooLongBytes(BCRYPT_MAX_PASSWORD_BYTES)}}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+
+	return err != nil || cost != h.cost
+}
+
+// Check a password against a hash in any supported format
+func verifyPassword(hash string, password string) error {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := parseArgon2idHash(hash)
+
+		if err != nil {
+			return ErrPasswordsDoNotMatch
+		}
+
+		other := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, uint32(len(key)))
+
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return ErrPasswordsDoNotMatch
+		}
+
+		return nil
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+
+		if err != nil {
+			return ErrPasswordsDoNotMatch
+		}
+
+		return nil
+	default:
+		// includes passwordless users, who have no hash
+		return ErrPasswordsDoNotMatch
+	}
+}
+
+func parseArgon2idHash(hash string) (*Argon2idHasher, []byte, []byte, error) {
+	// "", "argon2id", version, params, salt, key
+	parts := strings.Split(hash, "$")
+
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2id version")
+	}
+
+	var params Argon2idHasher
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism)
+
+	if err != nil || params.iterations == 0 || params.parallelism == 0 {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id salt")
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	return &params, salt, key, nil
+}
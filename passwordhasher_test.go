@@ -0,0 +1,290 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap settings so tests are fast
+func testArgon2idHasher() *Argon2idHasher {
+	return NewArgon2idHasher().SetMemory(64).SetIterations(1).SetParallelism(1)
+}
+
+// Swap the global hasher for the length of a test
+func setTestPasswordHasher(t *testing.T, hasher PasswordHasher) {
+	old := passwordHasher
+	SetPasswordHasher(hasher)
+	t.Cleanup(func() { SetPasswordHasher(old) })
+}
+
+func TestArgon2idHasherRoundTrip(t *testing.T) {
+	hasher := testArgon2idHasher()
+
+	hash, err := hasher.Hash("correct horse battery staple")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("hash is %s", hash)
+	}
+
+	err = verifyPassword(hash, "correct horse battery staple")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = verifyPassword(hash, "correct horse battery stapler")
+
+	if !errors.Is(err, ErrPasswordsDoNotMatch) {
+		t.Fatalf("wrong password: %v", err)
+	}
+
+	// salted, so the same password hashes differently each time
+	again, _ := hasher.Hash("correct horse battery staple")
+
+	if again == hash {
+		t.Fatal("hashes are not salted")
+	}
+
+	if hasher.NeedsRehash(hash) {
+		t.Fatal("hash made with the current settings needs a rehash")
+	}
+}
+
+func TestArgon2idHasherNeedsRehash(t *testing.T) {
+	hash, err := testArgon2idHasher().Hash("correct horse battery staple")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bcryptHash, err := NewBcryptHasher(bcrypt.MinCost).Hash("correct horse battery staple")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		hasher *Argon2idHasher
+		hash   string
+	}{
+		"memory":      {testArgon2idHasher().SetMemory(128), hash},
+		"iterations":  {testArgon2idHasher().SetIterations(2), hash},
+		"parallelism": {testArgon2idHasher().SetParallelism(2), hash},
+		"defaults":    {NewArgon2idHasher(), hash},
+		"bcrypt":      {testArgon2idHasher(), bcryptHash},
+		"invalid":     {testArgon2idHasher(), "$argon2id$v=19$m=64,t=1,p=1$"},
+		"empty":       {testArgon2idHasher(), ""},
+	}
+
+	for name, test := range tests {
+		if !test.hasher.NeedsRehash(test.hash) {
+			t.Errorf("%s: expected a rehash", name)
+		}
+	}
+}
+
+func TestArgon2idHashMalformed(t *testing.T) {
+	hash, err := testArgon2idHasher().Hash("correct horse battery staple")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(hash, "$")
+	salt := parts[4]
+	key := parts[5]
+
+	tests := map[string]string{
+		"no key":          "$argon2id$v=19$m=64,t=1,p=1$" + salt,
+		"extra part":      hash + "$",
+		"argon2i":         "$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key,
+		"old version":     "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key,
+		"no version":      "$argon2id$m=64,t=1,p=1$" + salt + "$" + key + "$",
+		"no params":       "$argon2id$v=19$$" + salt + "$" + key,
+		"bad params":      "$argon2id$v=19$m=64;t=1;p=1$" + salt + "$" + key,
+		"zero iterations": "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key,
+		"zero threads":    "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key,
+		"padded salt":     "$argon2id$v=19$m=64,t=1,p=1$" + salt + "==$" + key,
+		"bad salt":        "$argon2id$v=19$m=64,t=1,p=1$!!!!$" + key,
+		"empty key":       "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$",
+		"bad key":         "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key[1:] + "*",
+		"other key":       "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key[:len(key)-4] + "AAAA",
+		"other params":    "$argon2id$v=19$m=64,t=2,p=1$" + salt + "$" + key,
+	}
+
+	for name, hash := range tests {
+		err := verifyPassword(hash, "correct horse battery staple")
+
+		if !errors.Is(err, ErrPasswordsDoNotMatch) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+
+	// any other format is not ours
+	for _, hash := range []string{"", "correct horse battery staple", "$1$abc$def", "$scrypt$ln=16,r=8,p=1$aM15713r3Xsvxbi31lqr1Q$"} {
+		err := verifyPassword(hash, "correct horse battery staple")
+
+		if !errors.Is(err, ErrPasswordsDoNotMatch) {
+			t.Errorf("%q: got %v", hash, err)
+		}
+	}
+}
+
+func TestBcryptHasher(t *testing.T) {
+	hasher := NewBcryptHasher(bcrypt.MinCost)
+
+	hash, err := hasher.Hash("correct horse battery staple")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = verifyPassword(hash, "correct horse battery staple")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = verifyPassword(hash, "correct horse battery stapler")
+
+	if !errors.Is(err, ErrPasswordsDoNotMatch) {
+		t.Fatalf("wrong password: %v", err)
+	}
+
+	if hasher.NeedsRehash(hash) {
+		t.Fatal("hash made with the current cost needs a rehash")
+	}
+
+	if !NewBcryptHasher(bcrypt.MinCost + 1).NeedsRehash(hash) {
+		t.Fatal("hash made with a lower cost does not need a rehash")
+	}
+
+	argon2Hash, _ := testArgon2idHasher().Hash("correct horse battery staple")
+
+	if !hasher.NeedsRehash(argon2Hash) {
+		t.Fatal("argon2id hash does not need a rehash")
+	}
+
+	// 72 bytes is fine but 73 would be silently truncated
+	_, err = hasher.Hash(strings.Repeat("a", BCRYPT_MAX_PASSWORD_BYTES))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = hasher.Hash(strings.Repeat("a", BCRYPT_MAX_PASSWORD_BYTES+1))
+
+	var policyErr *PasswordPolicyError
+
+	if !errors.As(err, &policyErr) || policyErr.Violations[0].Code != PASSWORD_TOO_LONG {
+		t.Fatalf("expected a PasswordPolicyError, got %v", err)
+	}
+}
+
+// Hashes from other bcrypt implementations, e.g. from before the
+// hasher was argon2id
+func TestLegacyBcryptHashes(t *testing.T) {
+	setTestPasswordHasher(t, testArgon2idHasher())
+
+	tests := []struct {
+		password string
+		hash     string
+	}{
+		{"", "$2a$06$DCq7YPn5Rq63x1Lad4cll.TV4S6ytwfsfvkgY8jIucDrjc8deX1s."},
+		{"a", "$2a$06$m0CrhHm10qJ3lXRY.5zDGO3rS2KdeeWLuGmsfGlMfOxih58VYVfxe"},
+		{"abc", "$2a$06$If6bvum7DFjUnE9p2uDeDu0YHzrHM6tf.iqN8.yx.jNN1ILEf7h0i"},
+		// php and openbsd prefixes for the same algorithm
+		{"abc", "$2y$06$If6bvum7DFjUnE9p2uDeDu0YHzrHM6tf.iqN8.yx.jNN1ILEf7h0i"},
+		{"abc", "$2b$06$If6bvum7DFjUnE9p2uDeDu0YHzrHM6tf.iqN8.yx.jNN1ILEf7h0i"},
+	}
+
+	for _, test := range tests {
+		rehash, err := CheckPasswordsMatch(test.hash, test.password)
+
+		if err != nil {
+			t.Errorf("%s: %s", test.hash, err)
+			continue
+		}
+
+		if !rehash {
+			t.Errorf("%s: expected a rehash", test.hash)
+		}
+
+		_, err = CheckPasswordsMatch(test.hash, test.password+"x")
+
+		if !errors.Is(err, ErrPasswordsDoNotMatch) {
+			t.Errorf("%s: wrong password: %v", test.hash, err)
+		}
+	}
+}
+
+func TestCheckPasswordsMatch(t *testing.T) {
+	setTestPasswordHasher(t, testArgon2idHasher())
+
+	hash, err := HashPassword("ｐａｓｓｗｏｒｄ")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// normalized before hashing so either form matches
+	for _, password := range []string{"ｐａｓｓｗｏｒｄ", "password"} {
+		rehash, err := CheckPasswordsMatch(hash, password)
+
+		if err != nil || rehash {
+			t.Fatalf("%s: got %v, %v", password, rehash, err)
+		}
+	}
+
+	// upgrading the settings upgrades hashes as users sign in
+	SetPasswordHasher(testArgon2idHasher().SetIterations(2))
+
+	rehash, err := CheckPasswordsMatch(hash, "password")
+
+	if err != nil || !rehash {
+		t.Fatalf("after changing settings: got %v, %v", rehash, err)
+	}
+
+	// passwordless users have no hash
+	_, err = CheckPasswordsMatch("", "")
+
+	if !errors.Is(err, ErrPasswordsDoNotMatch) {
+		t.Fatalf("empty hash: %v", err)
+	}
+}
+
+func TestPasswordPolicyMaxBytes(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+
+	// 43 characters but 82 bytes
+	password := strings.Repeat("aé€", 13) + "Ab1!"
+
+	tooLong := func() bool {
+		for _, violation := range policy.Check(password, nil) {
+			if violation.Code == PASSWORD_TOO_LONG {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	setTestPasswordHasher(t, testArgon2idHasher())
+
+	if tooLong() {
+		t.Fatal("argon2id has no byte limit")
+	}
+
+	SetPasswordHasher(NewBcryptHasher(bcrypt.MinCost))
+
+	if !tooLong() {
+		t.Fatal("bcrypt limit was not enforced")
+	}
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+const DEFAULT_PASSWORD_HISTORY = 5
+
+const FIND_PASSWORD_SQL = `SELECT users.id, users.password FROM users WHERE users.uuid = ?`
+
+const PASSWORD_HISTORY_SQL = `SELECT password
+	FROM user_password_history
+	WHERE user_id = ?
+	ORDER BY id DESC
+	LIMIT ?`
+
+const INSERT_PASSWORD_HISTORY_SQL = `INSERT INTO user_password_history (user_id, password, created_at) VALUES (?, ?, ?)`
+
+// keep only the newest n, the derived table is because mysql does
+// not allow limit directly in an in subquery
+const PRUNE_PASSWORD_HISTORY_SQL = `DELETE FROM user_password_history
+	WHERE user_id = ? AND id NOT IN (
+		SELECT id FROM (
+			SELECT id FROM user_password_history
+			WHERE user_id = ?
+			ORDER BY id DESC
+			LIMIT ?) AS keep)`
+
+// The current and previous password hashes a new password must not
+// match, newest first. Empty if the policy does not keep a history.
+func (userdb *UserDb) passwordHistory(ctx context.Context, user *AuthUser) (uint, []string, error) {
+	var id uint
+	var current string
+
+	// the user may be stale so get the current hash
+	err := userdb.queryRow(ctx, FIND_PASSWORD_SQL, user.Uuid).Scan(&id, &current)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n := passwordPolicy.PasswordHistory
+
+	if n <= 0 {
+		return id, nil, nil
+	}
+
+	hashes := []string{current}
+
+	rows, err := userdb.query(ctx, PASSWORD_HISTORY_SQL, id, n)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+
+		err := rows.Scan(&hash)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	return id, hashes, rows.Err()
+}
+
+// Record the hash being replaced and forget any beyond the history
+// length
+func (userdb *UserDb) addPasswordHistory(ctx context.Context, userId uint, hash string) error {
+	n := passwordPolicy.PasswordHistory
+
+	// passwordless users have nothing to remember
+	if n <= 0 || hash == "" {
+		return nil
+	}
+
+	_, err := userdb.exec(ctx, INSERT_PASSWORD_HISTORY_SQL, userId, hash, time.Now().Unix())
+
+	if err != nil {
+		return err
+	}
+
+	_, err = userdb.exec(ctx, PRUNE_PASSWORD_HISTORY_SQL, userId, userId, n)
+
+	return err
+}
+
+// Reject a password that matches any of hashes
+func checkPasswordReuse(password string, hashes []string) error {
+	for _, hash := range hashes {
+		_, err := CheckPasswordsMatch(hash, password)
+
+		if err == nil {
+			return &PasswordPolicyError{Violations: []PasswordViolation{{Code: PASSWORD_REUSED,
+				Message: "password has been used before, please choose another"}}}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/yaml.v3"
+)
+
+const DEFAULT_MAX_PASSWORD_LENGTH = 128
+
+// parts of a user's details shorter than this are not checked for in
+// their password, otherwise short names would rule out too much
+const MIN_USER_INFO_LENGTH = 3
+
+// Codes the frontend can use to show its own messages
+const (
+	PASSWORD_TOO_SHORT          = "too_short"
+	PASSWORD_TOO_LONG           = "too_long"
+	PASSWORD_NEEDS_LOWER        = "needs_lower"
+	PASSWORD_NEEDS_UPPER        = "needs_upper"
+	PASSWORD_NEEDS_DIGIT        = "needs_digit"
+	PASSWORD_NEEDS_SYMBOL       = "needs_symbol"
+	PASSWORD_TOO_FEW_CLASSES    = "too_few_classes"
+	PASSWORD_CONTAINS_USER_INFO = "contains_user_info"
+	PASSWORD_BREACHED           = "breached"
+	PASSWORD_REUSED             = "reused"
+)
+
+// One rule a password broke. Value is the limit for rules that have
+// one, e.g. the minimum length.
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Value   int    `json:"value,omitempty"`
+}
+
+// Returned when a password breaks a policy, with every rule it broke
+// so they can all be shown at once
+type PasswordPolicyError struct {
+	Violations []PasswordViolation `json:"violations"`
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Message)
+	}
+
+	return strings.Join(messages, ", ")
+}
+
+// Rules passwords must follow. Lengths are in characters after
+// NFKC normalisation, so passphrases and non ascii passwords are
+// fine. Symbols are anything that is not a letter or digit,
+// including spaces.
+type PasswordPolicy struct {
+	MinLength     int  `json:"minLength" yaml:"minLength"`
+	MaxLength     int  `json:"maxLength" yaml:"maxLength"`
+	RequireLower  bool `json:"requireLower" yaml:"requireLower"`
+	RequireUpper  bool `json:"requireUpper" yaml:"requireUpper"`
+	RequireDigit  bool `json:"requireDigit" yaml:"requireDigit"`
+	RequireSymbol bool `json:"requireSymbol" yaml:"requireSymbol"`
+	// how many of lower, upper, digit and symbol must be used,
+	// e.g. 3 for any three of the four
+	MinCharacterClasses int `json:"minCharacterClasses" yaml:"minCharacterClasses"`
+	// reject passwords containing the user's email, username or name
+	DisallowUserInfo bool `json:"disallowUserInfo" yaml:"disallowUserInfo"`
+	// a HIBP password file, see BreachedPasswords, which
+	// LoadPasswordPolicy opens
+	BreachedPasswordsFile string `json:"breachedPasswordsFile" yaml:"breachedPasswordsFile"`
+	// reject passwords seen in breaches more than this many times,
+	// so 0 rejects any breached password
+	MaxBreachCount int `json:"maxBreachCount" yaml:"maxBreachCount"`
+	// how many previous passwords are remembered. A new password
+	// cannot be the current one or any of these. 0 turns this off.
+	PasswordHistory int `json:"passwordHistory" yaml:"passwordHistory"`
+	breached        *BreachedPasswords
+}
+
+// Length limits only, as NIST recommends, no user info and no
+// recent passwords
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{MinLength: MIN_PASSWORD_LENGTH,
+		MaxLength:        DEFAULT_MAX_PASSWORD_LENGTH,
+		DisallowUserInfo: true,
+		PasswordHistory:  DEFAULT_PASSWORD_HISTORY}
+}
+
+// Load a policy from a .json, .yaml or .yml file. Settings missing
+// from the file keep their default values.
+func LoadPasswordPolicy(file string) (*PasswordPolicy, error) {
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	policy := DefaultPasswordPolicy()
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		err = json.Unmarshal(data, policy)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, policy)
+	default:
+		return nil, fmt.Errorf("password policy must be json or yaml")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if policy.BreachedPasswordsFile != "" {
+		breached, err := OpenBreachedPasswords(policy.BreachedPasswordsFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		policy.breached = breached
+	}
+
+	return policy, nil
+}
+
+// Reject passwords found in breaches. Use nil to stop checking.
+func (policy *PasswordPolicy) SetBreachedPasswords(breached *BreachedPasswords) *PasswordPolicy {
+	policy.breached = breached
+	return policy
+}
+
+var passwordPolicy = DefaultPasswordPolicy()
+
+// Change the policy CheckPassword uses
+func SetPasswordPolicy(policy *PasswordPolicy) {
+	passwordPolicy = policy
+}
+
+// Passwords are normalised before they are checked and hashed so the
+// same password typed on different devices always matches
+func NormalizePassword(password string) string {
+	return norm.NFKC.String(password)
+}
+
+// Check a password against the policy. user can be nil, or only have
+// the details known so far when the user is being created.
+func (policy *PasswordPolicy) Check(password string, user *AuthUser) []PasswordViolation {
+	password = NormalizePassword(password)
+
+	violations := make([]PasswordViolation, 0, 2)
+
+	length := utf8.RuneCountInString(password)
+
+	if length < policy.MinLength {
+		violations = append(violations, PasswordViolation{Code: PASSWORD_TOO_SHORT,
+			Message: fmt.Sprintf("password must be at least %d characters", policy.MinLength),
+			Value:   policy.MinLength})
+	}
+
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		violations = append(violations, PasswordViolation{Code: PASSWORD_TOO_LONG,
+			Message: fmt.Sprintf("password must be at most %d characters", policy.MaxLength),
+			Value:   policy.MaxLength})
+	} else if hasher, ok := passwordHasher.(MaxPasswordBytesHasher); ok && len(password) > hasher.MaxPasswordBytes() {
+		// a password within MaxLength can still be too long for the
+		// hasher, e.g. bcrypt, especially if it is not ascii
+		violations = append(violations, passwordTooLongBytes(hasher.MaxPasswordBytes()))
+	}
+
+	var lower, upper, digit, symbol bool
+
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			symbol = true
+		}
+	}
+
+	if policy.RequireLower && !lower {
+		violations = append(violations, PasswordViolation{Code: PASSWORD_NEEDS_LOWER,
+			Message: "password must contain a lowercase letter"})
+	}
+
+	if policy.RequireUpper && !upper {
+		violations = append(violations, PasswordViolation{Code: PASSWORD_NEEDS_UPPER,
+			Message: "password must contain an uppercase letter"})
+	}
+
+	if policy.RequireDigit && !digit {
+		violations = append(violations, PasswordViolation{Code: PASSWORD_NEEDS_DIGIT,
+			Message: "password must contain a digit"})
+	}
+
+	if policy.RequireSymbol && !symbol {
+		violations = append(violations, PasswordViolation{Code: PASSWORD_NEEDS_SYMBOL,
+			Message: "password must contain a symbol"})
+	}
+
+	classes := 0
+
+	for _, used := range []bool{lower, upper, digit, symbol} {
+		if used {
+			classes++
+		}
+	}
+
+	if classes < policy.MinCharacterClasses {
+		violations = append(violations, PasswordViolation{Code: PASSWORD_TOO_FEW_CLASSES,
+			Message: fmt.Sprintf("password must use at least %d of lowercase letters, uppercase letters, digits and symbols", policy.MinCharacterClasses),
+			Value:   policy.MinCharacterClasses})
+	}
+
+	if policy.DisallowUserInfo && user != nil && containsUserInfo(password, user) {
+		violations = append(violations, PasswordViolation{Code: PASSWORD_CONTAINS_USER_INFO,
+			Message: "password must not contain your email, username or name"})
+	}
+
+	if policy.breached != nil {
+		count, err := policy.breached.Count(password)
+
+		// a bad file should not stop everyone setting passwords, so
+		// log it and carry on
+		if err != nil {
+			log.Error().Msgf("could not check breached passwords %s", err)
+		} else if count > policy.MaxBreachCount {
+			violations = append(violations, PasswordViolation{Code: PASSWORD_BREACHED,
+				Message: "password has appeared in a data breach, please choose another",
+				Value:   count})
+		}
+	}
+
+	return violations
+}
+
+// Like Check, but returns a *PasswordPolicyError if there are any
+// violations
+func (policy *PasswordPolicy) Validate(password string, user *AuthUser) error {
+	violations := policy.Check(password, user)
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+func passwordTooLongBytes(limit int) PasswordViolation {
+	return PasswordViolation{Code: PASSWORD_TOO_LONG,
+		Message: fmt.Sprintf("password must be at most %d bytes", limit),
+		Value:   limit}
+}
+
+func containsUserInfo(password string, user *AuthUser) bool {
+	password = strings.ToLower(password)
+
+	email := strings.ToLower(user.Email)
+	local, _, _ := strings.Cut(email, "@")
+
+	for _, info := range []string{email, local, user.Username, user.FirstName, user.LastName} {
+		info = strings.ToLower(NormalizePassword(info))
+
+		if utf8.RuneCountInString(info) >= MIN_USER_INFO_LENGTH && strings.Contains(password, info) {
+			return true
+		}
+	}
+
+	return false
+}
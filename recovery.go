@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	RECOVERY_CODE_COUNT = 10
+	// two groups of 5 characters, e.g. k7m2p-x9qrt
+	RECOVERY_CODE_GROUP = 5
+	// no 0/o or 1/l so codes can be read back from paper
+	RECOVERY_CODE_CHARS = "23456789abcdefghjkmnpqrstuvwxyz"
+)
+
+var ErrRecoveryCodeInvalid = errors.New("recovery code is invalid")
+
+// Hashes of a user's unused recovery codes
+type RecoveryCodeStore interface {
+	// Replace all of a user's codes
+	SetRecoveryCodes(ctx context.Context, user *AuthUser, hashes []string) error
+	// Delete a code. Returns false if the user has no such code.
+	UseRecoveryCode(ctx context.Context, user *AuthUser, hash string) (bool, error)
+	CountRecoveryCodes(ctx context.Context, user *AuthUser) (uint, error)
+	DeleteRecoveryCodes(ctx context.Context, user *AuthUser) error
+}
+
+const INSERT_RECOVERY_CODE_SQL = `INSERT INTO user_recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)`
+
+const USE_RECOVERY_CODE_SQL = `DELETE FROM user_recovery_codes WHERE user_id = ? AND code_hash = ?`
+
+const COUNT_RECOVERY_CODES_SQL = `SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = ?`
+
+const DELETE_RECOVERY_CODES_SQL = `DELETE FROM user_recovery_codes WHERE user_id = ?`
+
+const USERS_RECOVERY_CODES_SQL string = `SELECT
+	user_recovery_codes.user_id, COUNT(*)
+	FROM user_recovery_codes
+	WHERE user_recovery_codes.user_id IN (%s)
+	GROUP BY user_recovery_codes.user_id`
+
+func (userdb *UserDb) SetRecoveryCodes(ctx context.Context, user *AuthUser, hashes []string) error {
+	return userdb.withTx(ctx, func(tx *UserDb) error {
+		_, err := tx.exec(ctx, DELETE_RECOVERY_CODES_SQL, user.Id)
+
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().Unix()
+
+		for _, hash := range hashes {
+			_, err = tx.exec(ctx, INSERT_RECOVERY_CODE_SQL, user.Id, hash, now)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (userdb *UserDb) UseRecoveryCode(ctx context.Context, user *AuthUser, hash string) (bool, error) {
+	result, err := userdb.exec(ctx, USE_RECOVERY_CODE_SQL, user.Id, hash)
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (userdb *UserDb) CountRecoveryCodes(ctx context.Context, user *AuthUser) (uint, error) {
+	var n uint
+
+	err := userdb.queryRow(ctx, COUNT_RECOVERY_CODES_SQL, user.Id).Scan(&n)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (userdb *UserDb) DeleteRecoveryCodes(ctx context.Context, user *AuthUser) error {
+	_, err := userdb.exec(ctx, DELETE_RECOVERY_CODES_SQL, user.Id)
+
+	return err
+}
+
+// Single use codes a user can enter instead of a totp code if they
+// lose their authenticator. Codes are random enough that a plain
+// sha256 hash is sufficient, which lets us look them up directly.
+type RecoveryCodes struct {
+	store    RecoveryCodeStore
+	throttle *LoginThrottle
+}
+
+func NewRecoveryCodes(store RecoveryCodeStore) *RecoveryCodes {
+	return &RecoveryCodes{store: store}
+}
+
+// Needed to redeem codes. Wrong codes count against the user in the
+// same way as wrong totp codes.
+func (rc *RecoveryCodes) SetLoginThrottle(throttle *LoginThrottle) *RecoveryCodes {
+	rc.throttle = throttle
+	return rc
+}
+
+// Make a new batch of codes for the user, invalidating any they
+// had before. The codes are only returned here so must be shown
+// to the user straight away.
+func (rc *RecoveryCodes) Generate(ctx context.Context, user *AuthUser) ([]string, error) {
+	codes := make([]string, RECOVERY_CODE_COUNT)
+	hashes := make([]string, RECOVERY_CODE_COUNT)
+
+	for ci := range codes {
+		code, err := newRecoveryCode()
+
+		if err != nil {
+			return nil, err
+		}
+
+		codes[ci] = code
+		hashes[ci] = hashRecoveryCode(code)
+	}
+
+	err := rc.store.SetRecoveryCodes(ctx, user, hashes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Use a code as the second factor when signing in. Each code works
+// once. Returns a *LoginLockedError without checking the code if
+// there have been too many wrong codes.
+func (rc *RecoveryCodes) Redeem(ctx context.Context, user *AuthUser, code string) error {
+	if rc.throttle == nil {
+		return fmt.Errorf("login throttle not set")
+	}
+
+	err := rc.throttle.CheckMfa(ctx, user)
+
+	if err != nil {
+		return err
+	}
+
+	ok, err := rc.store.UseRecoveryCode(ctx, user, hashRecoveryCode(code))
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		err = rc.throttle.FailMfa(ctx, user)
+
+		if err != nil {
+			return err
+		}
+
+		return ErrRecoveryCodeInvalid
+	}
+
+	return rc.throttle.SucceedMfa(ctx, user)
+}
+
+func (rc *RecoveryCodes) Remaining(ctx context.Context, user *AuthUser) (uint, error) {
+	return rc.store.CountRecoveryCodes(ctx, user)
+}
+
+func newRecoveryCode() (string, error) {
+	data := make([]byte, 2*RECOVERY_CODE_GROUP)
+
+	_, err := rand.Read(data)
+
+	if err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+
+	for bi, b := range data {
+		if bi == RECOVERY_CODE_GROUP {
+			buf.WriteByte('-')
+		}
+
+		// 256 is not a multiple of len(chars) but the slight bias
+		// still leaves around 49 bits per code
+		buf.WriteByte(RECOVERY_CODE_CHARS[int(b)%len(RECOVERY_CODE_CHARS)])
+	}
+
+	return buf.String(), nil
+}
+
+// Codes are hashed ignoring case, spaces and dashes so users can
+// type them however they like
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+
+	sum := sha256.Sum256([]byte(code))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// A user in a fresh MemUserDb
+func newTestUser(t *testing.T) (*MemUserDb, *AuthUser) {
+	t.Helper()
+
+	db := NewMemUserDB()
+
+	email, _ := mail.ParseAddress("ann@example.org")
+
+	user, err := db.CreateUser(t.Context(), "ann", email, "correct horse battery staple", "Ann", "Smith", true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db, user
+}
+
+func newTestRecoveryCodes(t *testing.T) (*RecoveryCodes, *AuthUser, []string) {
+	t.Helper()
+
+	db, user := newTestUser(t)
+
+	throttle := NewLoginThrottle(db).
+		SetMaxFailures(3).
+		SetSecurityEventHandler(func(ctx context.Context, event *SecurityEvent) {})
+
+	rc := NewRecoveryCodes(db).SetLoginThrottle(throttle)
+
+	codes, err := rc.Generate(t.Context(), user)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rc, user, codes
+}
+
+func TestRecoveryCodesGenerate(t *testing.T) {
+	rc, user, codes := newTestRecoveryCodes(t)
+
+	if len(codes) != RECOVERY_CODE_COUNT {
+		t.Fatalf("got %d codes", len(codes))
+	}
+
+	seen := make(map[string]bool)
+
+	for _, code := range codes {
+		if len(code) != 2*RECOVERY_CODE_GROUP+1 || code[RECOVERY_CODE_GROUP] != '-' {
+			t.Fatalf("code %q is the wrong shape", code)
+		}
+
+		for _, c := range strings.ReplaceAll(code, "-", "") {
+			if !strings.ContainsRune(RECOVERY_CODE_CHARS, c) {
+				t.Fatalf("code %q has %q", code, c)
+			}
+		}
+
+		seen[code] = true
+	}
+
+	if len(seen) != len(codes) {
+		t.Fatal("duplicate codes")
+	}
+
+	n, err := rc.Remaining(t.Context(), user)
+
+	if err != nil || n != RECOVERY_CODE_COUNT {
+		t.Fatalf("%d remaining: %v", n, err)
+	}
+
+	// a new batch replaces the old one
+	old := codes[0]
+
+	_, err = rc.Generate(t.Context(), user)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, _ = rc.Remaining(t.Context(), user)
+
+	if n != RECOVERY_CODE_COUNT {
+		t.Fatalf("%d remaining after regenerating", n)
+	}
+
+	err = rc.Redeem(t.Context(), user, old)
+
+	if !errors.Is(err, ErrRecoveryCodeInvalid) {
+		t.Fatalf("code from the old batch: %v", err)
+	}
+}
+
+func TestRecoveryCodesRedeemOnce(t *testing.T) {
+	rc, user, codes := newTestRecoveryCodes(t)
+
+	err := rc.Redeem(t.Context(), user, codes[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = rc.Redeem(t.Context(), user, codes[0])
+
+	if !errors.Is(err, ErrRecoveryCodeInvalid) {
+		t.Fatalf("code used twice: %v", err)
+	}
+
+	err = rc.Redeem(t.Context(), user, codes[1])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := rc.Remaining(t.Context(), user)
+
+	if err != nil || n != RECOVERY_CODE_COUNT-2 {
+		t.Fatalf("%d remaining: %v", n, err)
+	}
+}
+
+func TestRecoveryCodesNormalise(t *testing.T) {
+	rc, user, codes := newTestRecoveryCodes(t)
+
+	tests := map[string]string{
+		"upper case":   strings.ToUpper(codes[0]),
+		"no dash":      strings.ReplaceAll(codes[1], "-", ""),
+		"space":        strings.ReplaceAll(codes[2], "-", " "),
+		"extra dashes": strings.Join(strings.Split(codes[3], ""), "-"),
+		"mixed":        " " + strings.ToUpper(codes[4][:3]) + " " + codes[4][3:] + " ",
+	}
+
+	for name, code := range tests {
+		err := rc.Redeem(t.Context(), user, code)
+
+		if err != nil {
+			t.Errorf("%s %q: %v", name, code, err)
+		}
+	}
+
+	n, _ := rc.Remaining(t.Context(), user)
+
+	if n != RECOVERY_CODE_COUNT-uint(len(tests)) {
+		t.Fatalf("%d remaining", n)
+	}
+
+	// other characters still matter
+	err := rc.Redeem(t.Context(), user, codes[5]+"x")
+
+	if !errors.Is(err, ErrRecoveryCodeInvalid) {
+		t.Fatalf("expected ErrRecoveryCodeInvalid, got %v", err)
+	}
+}
+
+func TestRecoveryCodesThrottled(t *testing.T) {
+	rc, user, codes := newTestRecoveryCodes(t)
+
+	for range 3 {
+		rc.Redeem(t.Context(), user, "aaaaa-aaaaa")
+	}
+
+	// locked, so the code is not checked or used up
+	err := rc.Redeem(t.Context(), user, codes[0])
+
+	if !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("expected ErrLoginLocked, got %v", err)
+	}
+
+	n, _ := rc.Remaining(t.Context(), user)
+
+	if n != RECOVERY_CODE_COUNT {
+		t.Fatalf("%d remaining", n)
+	}
+}
+
+func TestRecoveryCodesNeedThrottle(t *testing.T) {
+	rc, user, codes := newTestRecoveryCodes(t)
+
+	rc.SetLoginThrottle(nil)
+
+	if rc.Redeem(t.Context(), user, codes[0]) == nil {
+		t.Fatal("redeemed without a throttle")
+	}
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrTokenReused = errors.New("refresh token has already been used")
+
+// A refresh token as it is kept in the store. Each refresh token
+// belongs to a family started when the user signs in. Using a token
+// marks it as used and issues the next token in the same family so
+// a token that turns up a second time must have been copied. Times
+// are unix seconds and UsedAt and RevokedAt are 0 until set.
+type RefreshTokenRecord struct {
+	Id        string `json:"id"`
+	FamilyId  string `json:"familyId"`
+	UserId    uint   `json:"-"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+	UsedAt    int64  `json:"usedAt"`
+	RevokedAt int64  `json:"revokedAt"`
+}
+
+type RefreshTokenStore interface {
+	AddRefreshToken(ctx context.Context, token *RefreshTokenRecord) error
+	FindRefreshToken(ctx context.Context, id string) (*RefreshTokenRecord, error)
+	// Mark a token as used. Returns false if it was already used
+	// so concurrent requests with the same token cannot both win.
+	UseRefreshToken(ctx context.Context, id string, usedAt int64) (bool, error)
+	RevokeRefreshTokenFamily(ctx context.Context, familyId string, revokedAt int64) error
+	// Delete tokens that expired before now
+	DeleteExpiredRefreshTokens(ctx context.Context, now int64) error
+}
+
+const INSERT_REFRESH_TOKEN_SQL = `INSERT INTO refresh_tokens
+	(id, family_id, user_id, created_at, expires_at)
+	VALUES (?, ?, ?, ?, ?)`
+
+const FIND_REFRESH_TOKEN_SQL = `SELECT
+	id, family_id, user_id, created_at, expires_at, used_at, revoked_at
+	FROM refresh_tokens
+	WHERE id = ?`
+
+const USE_REFRESH_TOKEN_SQL = `UPDATE refresh_tokens SET used_at = ? WHERE id = ? AND used_at = 0`
+
+const REVOKE_REFRESH_TOKEN_FAMILY_SQL = `UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at = 0`
+
+const DELETE_EXPIRED_REFRESH_TOKENS_SQL = `DELETE FROM refresh_tokens WHERE expires_at < ?`
+
+func (userdb *UserDb) AddRefreshToken(ctx context.Context, token *RefreshTokenRecord) error {
+	_, err := userdb.exec(ctx,
+		INSERT_REFRESH_TOKEN_SQL,
+		token.Id,
+		token.FamilyId,
+		token.UserId,
+		token.CreatedAt,
+		token.ExpiresAt)
+
+	return err
+}
+
+func (userdb *UserDb) FindRefreshToken(ctx context.Context, id string) (*RefreshTokenRecord, error) {
+	var token RefreshTokenRecord
+
+	err := userdb.queryRow(ctx, FIND_REFRESH_TOKEN_SQL, id).Scan(&token.Id,
+		&token.FamilyId,
+		&token.UserId,
+		&token.CreatedAt,
+		&token.ExpiresAt,
+		&token.UsedAt,
+		&token.RevokedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (userdb *UserDb) UseRefreshToken(ctx context.Context, id string, usedAt int64) (bool, error) {
+	result, err := userdb.exec(ctx, USE_REFRESH_TOKEN_SQL, usedAt, id)
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (userdb *UserDb) RevokeRefreshTokenFamily(ctx context.Context, familyId string, revokedAt int64) error {
+	_, err := userdb.exec(ctx, REVOKE_REFRESH_TOKEN_FAMILY_SQL, revokedAt, familyId)
+
+	return err
+}
+
+func (userdb *UserDb) DeleteExpiredRefreshTokens(ctx context.Context, now int64) error {
+	_, err := userdb.exec(ctx, DELETE_EXPIRED_REFRESH_TOKENS_SQL, now)
+
+	return err
+}
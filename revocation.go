@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Records the ids (jti) of tokens revoked before they expire, e.g.
+// a reset password link that has been shared or an access token
+// that leaked. Entries are only needed until the token would have
+// expired anyway, so revoking a token also prunes expired entries.
+type RevocationStore interface {
+	RevokeToken(ctx context.Context, id string, expiresAt int64) error
+	IsTokenRevoked(ctx context.Context, id string) (bool, error)
+	// Delete entries for tokens that expired before now
+	DeleteExpiredRevokedTokens(ctx context.Context, now int64) error
+}
+
+const INSERT_REVOKED_TOKEN_SQL = `INSERT IGNORE INTO revoked_tokens (id, expires_at, revoked_at) VALUES (?, ?, ?)`
+
+const IS_TOKEN_REVOKED_SQL = `SELECT id FROM revoked_tokens WHERE id = ?`
+
+const DELETE_EXPIRED_REVOKED_TOKENS_SQL = `DELETE FROM revoked_tokens WHERE expires_at < ?`
+
+func (userdb *UserDb) RevokeToken(ctx context.Context, id string, expiresAt int64) error {
+	now := time.Now().Unix()
+
+	_, err := userdb.exec(ctx, INSERT_REVOKED_TOKEN_SQL, id, expiresAt, now)
+
+	if err != nil {
+		return err
+	}
+
+	return userdb.DeleteExpiredRevokedTokens(ctx, now)
+}
+
+func (userdb *UserDb) IsTokenRevoked(ctx context.Context, id string) (bool, error) {
+	err := userdb.queryRow(ctx, IS_TOKEN_REVOKED_SQL, id).Scan(&id)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (userdb *UserDb) DeleteExpiredRevokedTokens(ctx context.Context, now int64) error {
+	_, err := userdb.exec(ctx, DELETE_EXPIRED_REVOKED_TOKENS_SQL, now)
+
+	return err
+}
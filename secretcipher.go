@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// Encrypts secrets such as totp keys before they are stored, so a
+// copy of the database alone is not enough to generate codes. The
+// key should be 32 random bytes kept out of the database, e.g. in
+// an env variable.
+type SecretCipher struct {
+	aead cipher.AEAD
+}
+
+func NewSecretCipher(key []byte) (*SecretCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secret key must be 32 bytes")
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecretCipher{aead: aead}, nil
+}
+
+// Create a cipher from a base64 encoded key
+func NewSecretCipherFromBase64(key string) (*SecretCipher, error) {
+	data, err := base64.StdEncoding.DecodeString(key)
+
+	if err != nil {
+		return nil, fmt.Errorf("secret key is not base64")
+	}
+
+	return NewSecretCipher(data)
+}
+
+// Encrypt a secret with AES-GCM. The context, e.g. the user's uuid,
+// is authenticated but not stored, so a ciphertext copied to another
+// user's row will not decrypt.
+func (sc *SecretCipher) Encrypt(plaintext []byte, context []byte) (string, error) {
+	nonce := make([]byte, sc.aead.NonceSize(), sc.aead.NonceSize()+len(plaintext)+sc.aead.Overhead())
+
+	_, err := rand.Read(nonce)
+
+	if err != nil {
+		return "", err
+	}
+
+	data := sc.aead.Seal(nonce, nonce, plaintext, context)
+
+	return base64.RawStdEncoding.EncodeToString(data), nil
+}
+
+func (sc *SecretCipher) Decrypt(ciphertext string, context []byte) ([]byte, error) {
+	data, err := base64.RawStdEncoding.DecodeString(ciphertext)
+
+	if err != nil || len(data) < sc.aead.NonceSize() {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+
+	nonce := data[:sc.aead.NonceSize()]
+
+	plaintext, err := sc.aead.Open(nil, nonce, data[sc.aead.NonceSize():], context)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt secret")
+	}
+
+	return plaintext, nil
+}
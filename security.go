@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type SecurityEventType = string
+
+const (
+	// a refresh token was used after it had already been rotated
+	REFRESH_TOKEN_REUSED_EVENT SecurityEventType = "refresh_token_reused"
+	// a passkey's sign count did not go up, which suggests the
+	// authenticator has been cloned
+	WEBAUTHN_SIGN_COUNT_EVENT SecurityEventType = "webauthn_sign_count"
+	// an account or ip address was locked out after too many failed
+	// sign ins
+	LOGIN_LOCKED_EVENT SecurityEventType = "login_locked"
+)
+
+// Something suspicious happened that an app may want to alert on
+// or record in an audit log
+type SecurityEvent struct {
+	Type SecurityEventType `json:"type"`
+	// public id of the user concerned
+	UserId   string `json:"userId"`
+	TokenId  string `json:"tokenId,omitempty"`
+	FamilyId string `json:"familyId,omitempty"`
+	// id of the passkey concerned
+	CredentialId string `json:"credentialId,omitempty"`
+	// client address for events about sign ins
+	Ip   string    `json:"ip,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+type SecurityEventHandler func(ctx context.Context, event *SecurityEvent)
+
+// The default handler, which writes events to the log as warnings
+func LogSecurityEvent(ctx context.Context, event *SecurityEvent) {
+	log.Warn().
+		Str("type", event.Type).
+		Str("userId", event.UserId).
+		Str("tokenId", event.TokenId).
+		Str("familyId", event.FamilyId).
+		Str("credentialId", event.CredentialId).
+		Str("ip", event.Ip).
+		Time("time", event.Time).
+		Msg("security event")
+}
@@ -1,14 +1,21 @@
 package auth
 
 import (
-	"crypto/rsa"
+	"context"
+	"crypto"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/mail"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/antonybholmes/go-sys/env"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 // type TokenType = uint
@@ -33,6 +40,9 @@ const (
 	REFRESH_TOKEN        TokenType = "refresh"
 	ACCESS_TOKEN         TokenType = "access"
 	OTP_TOKEN            TokenType = "otp"
+	// the password was correct but a second factor is still
+	// needed to finish signing in
+	MFA_PENDING_TOKEN TokenType = "mfa_pending"
 	// returns session info such as user and is not used for
 	// any type of auth
 	SESSION_TOKEN TokenType = "session"
@@ -53,13 +63,13 @@ const JWT_CLAIM_SEP = " "
 
 type TokenClaims struct {
 	jwt.RegisteredClaims
-	UserId          string    `json:"userId"`
-	Data            string    `json:"data,omitempty"`
-	OneTimePasscode string    `json:"otp,omitempty"`
-	Scope           string    `json:"scope,omitempty"`
-	Roles           string    `json:"roles,omitempty"`
-	RedirectUrl     string    `json:"redirectUrl,omitempty"`
-	Type            TokenType `json:"type"`
+	UserId      string    `json:"userId"`
+	Data        string    `json:"data,omitempty"`
+	Scope       string    `json:"scope,omitempty"`
+	Roles       string    `json:"roles,omitempty"`
+	RedirectUrl string    `json:"redirectUrl,omitempty"`
+	FamilyId    string    `json:"fid,omitempty"`
+	Type        TokenType `json:"type"`
 }
 
 const EMAIL_CLAIM = "https://edb.rdf-lab.org/email"
@@ -106,17 +116,74 @@ func MakeClaim(claims []string) string {
 }
 
 type TokenCreator struct {
-	secret         *rsa.PrivateKey
-	accessTokenTTL time.Duration
-	otpTokenTTL    time.Duration
-	shortTTL       time.Duration
+	keys            *KeyRing
+	accessTokenTTL  time.Duration
+	otpTokenTTL     time.Duration
+	shortTTL        time.Duration
+	refreshTokenTTL time.Duration
+	refreshTokens   RefreshTokenStore
+	securityEvents  SecurityEventHandler
+	issuer          string
+	audiences       map[TokenType]jwt.ClaimStrings
 }
 
-func NewTokenCreator(secret *rsa.PrivateKey) *TokenCreator {
-	return &TokenCreator{secret: secret,
-		accessTokenTTL: env.GetMin("ACCESS_TOKEN_TTL_MINS", TTL_15_MINS),
-		otpTokenTTL:    env.GetMin("OTP_TOKEN_TTL_MINS", TTL_20_MINS),
-		shortTTL:       env.GetMin("SHORT_TTL_MINS", TTL_10_MINS)}
+// Sign tokens with an rsa, P-256 or ed25519 private key. The
+// algorithm (RS256, ES256 or EdDSA) is picked to match the key.
+// Returns an error if the key is not one of these.
+func NewTokenCreator(secret crypto.Signer) (*TokenCreator, error) {
+	keys, err := NewKeyRing(secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTokenCreatorWithKeyRing(keys), nil
+}
+
+// Sign tokens with the current key of a key ring so the key can be
+// rotated without invalidating tokens already issued
+func NewTokenCreatorWithKeyRing(keys *KeyRing) *TokenCreator {
+	return &TokenCreator{keys: keys,
+		accessTokenTTL:  env.GetMin("ACCESS_TOKEN_TTL_MINS", TTL_15_MINS),
+		otpTokenTTL:     env.GetMin("OTP_TOKEN_TTL_MINS", TTL_20_MINS),
+		shortTTL:        env.GetMin("SHORT_TTL_MINS", TTL_10_MINS),
+		refreshTokenTTL: env.GetMin("REFRESH_TOKEN_TTL_MINS", TTL_HOUR),
+		securityEvents:  LogSecurityEvent,
+		issuer:          os.Getenv("TOKEN_ISSUER"),
+		audiences:       make(map[TokenType]jwt.ClaimStrings)}
+}
+
+// The iss claim of every token, usually the url of the app
+func (tc *TokenCreator) SetIssuer(issuer string) *TokenCreator {
+	tc.issuer = issuer
+	return tc
+}
+
+// The aud claim of tokens of a given type, e.g. the services an
+// access token may be used with
+func (tc *TokenCreator) SetAudience(tokenType TokenType, audience ...string) *TokenCreator {
+	tc.audiences[tokenType] = audience
+	return tc
+}
+
+func (tc *TokenCreator) KeyRing() *KeyRing {
+	return tc.keys
+}
+
+// The longest any token issued by the creator lives for. Keys
+// rotated out must be kept at least this long.
+func (tc *TokenCreator) MaxTTL() time.Duration {
+	return max(tc.accessTokenTTL, tc.otpTokenTTL, tc.shortTTL, tc.refreshTokenTTL)
+}
+
+// Switch to a new key from generate every interval, retiring old
+// keys once every token they signed has expired. ttl is the longest
+// TTL passed to BasicToken, if that is longer than MaxTTL.
+func (tc *TokenCreator) StartKeyRotation(ctx context.Context,
+	interval time.Duration,
+	ttl time.Duration,
+	generate func() (crypto.Signer, error)) {
+	tc.keys.StartRotation(ctx, interval, max(tc.MaxTTL(), ttl), generate)
 }
 
 func (tc *TokenCreator) SetAccessTokenTTL(ttl time.Duration) *TokenCreator {
@@ -129,11 +196,115 @@ func (tc *TokenCreator) SetOTPTokenTTL(ttl time.Duration) *TokenCreator {
 	return tc
 }
 
+func (tc *TokenCreator) SetRefreshTokenTTL(ttl time.Duration) *TokenCreator {
+	tc.refreshTokenTTL = ttl
+	return tc
+}
+
+// Refresh tokens are recorded in the store so they can be rotated
+// and revoked. A store must be set before refresh tokens are issued.
+func (tc *TokenCreator) SetRefreshTokenStore(store RefreshTokenStore) *TokenCreator {
+	tc.refreshTokens = store
+	return tc
+}
+
+func (tc *TokenCreator) SetSecurityEventHandler(handler SecurityEventHandler) *TokenCreator {
+	tc.securityEvents = handler
+	return tc
+}
+
+// Issue a refresh token starting a new family, e.g. when a user
+// signs in
 func (tc *TokenCreator) RefreshToken(c *gin.Context, user *AuthUser) (string, error) {
-	return tc.BasicToken(c,
-		user.Uuid,
-		REFRESH_TOKEN,
-		TTL_HOUR)
+	return tc.refreshToken(requestContext(c), user.Id, user.Uuid, uuid.NewString())
+}
+
+// Exchange a verified refresh token for the next one in its family.
+// Each refresh token can only be rotated once. If one is presented
+// again, someone else has a copy, so every token in the family is
+// revoked, forcing the user to sign in again, and a security event
+// is raised.
+func (tc *TokenCreator) RotateRefreshToken(c *gin.Context, claims *TokenClaims) (string, error) {
+	if tc.refreshTokens == nil {
+		return "", fmt.Errorf("refresh token store not set")
+	}
+
+	if claims.Type != REFRESH_TOKEN {
+		return "", ErrTokenWrongType
+	}
+
+	ctx := requestContext(c)
+
+	record, err := tc.refreshTokens.FindRefreshToken(ctx, claims.ID)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrTokenInvalid
+		}
+
+		return "", err
+	}
+
+	if record.FamilyId != claims.FamilyId {
+		return "", ErrTokenInvalid
+	}
+
+	if record.RevokedAt != 0 {
+		return "", ErrTokenRevoked
+	}
+
+	now := time.Now()
+
+	ok, err := tc.refreshTokens.UseRefreshToken(ctx, record.Id, now.Unix())
+
+	if err != nil {
+		return "", err
+	}
+
+	if !ok {
+		err = tc.refreshTokens.RevokeRefreshTokenFamily(ctx, record.FamilyId, now.Unix())
+
+		if err != nil {
+			return "", err
+		}
+
+		if tc.securityEvents != nil {
+			tc.securityEvents(ctx, &SecurityEvent{Type: REFRESH_TOKEN_REUSED_EVENT,
+				UserId:   claims.UserId,
+				TokenId:  record.Id,
+				FamilyId: record.FamilyId,
+				Time:     now})
+		}
+
+		return "", ErrTokenReused
+	}
+
+	return tc.refreshToken(ctx, record.UserId, claims.UserId, record.FamilyId)
+}
+
+func (tc *TokenCreator) refreshToken(ctx context.Context, userId uint, publicId string, familyId string) (string, error) {
+	if tc.refreshTokens == nil {
+		return "", fmt.Errorf("refresh token store not set")
+	}
+
+	claims := TokenClaims{
+		UserId:           publicId,
+		Type:             REFRESH_TOKEN,
+		FamilyId:         familyId,
+		RegisteredClaims: tc.registeredClaims(REFRESH_TOKEN, publicId, tc.refreshTokenTTL),
+	}
+
+	err := tc.refreshTokens.AddRefreshToken(ctx, &RefreshTokenRecord{Id: claims.ID,
+		FamilyId:  familyId,
+		UserId:    userId,
+		CreatedAt: time.Now().Unix(),
+		ExpiresAt: claims.ExpiresAt.Unix()})
+
+	if err != nil {
+		return "", err
+	}
+
+	return tc.BaseToken(claims)
 }
 
 func (tc *TokenCreator) AccessToken(c *gin.Context, publicId string, roles string) (string, error) {
@@ -143,7 +314,7 @@ func (tc *TokenCreator) AccessToken(c *gin.Context, publicId string, roles strin
 		//IpAddr:           ipAddr,
 		Type:             ACCESS_TOKEN,
 		Roles:            roles,
-		RegisteredClaims: makeDefaultClaimsWithTTL(tc.accessTokenTTL)}
+		RegisteredClaims: tc.registeredClaims(ACCESS_TOKEN, publicId, tc.accessTokenTTL)}
 
 	return tc.BaseToken(claims)
 }
@@ -158,7 +329,7 @@ func (tc *TokenCreator) VerifyEmailToken(c *gin.Context, authUser *AuthUser, vis
 		Data:             authUser.FirstName,
 		Type:             VERIFY_EMAIL_TOKEN,
 		RedirectUrl:      visitUrl,
-		RegisteredClaims: makeDefaultClaimsWithTTL(tc.shortTTL),
+		RegisteredClaims: tc.registeredClaims(VERIFY_EMAIL_TOKEN, authUser.Uuid, tc.shortTTL),
 	}
 
 	return tc.BaseToken(claims)
@@ -170,20 +341,17 @@ func (tc *TokenCreator) ResetPasswordToken(c *gin.Context, user *AuthUser) (stri
 		// include first name to personalize reset
 		Data:             user.FirstName,
 		Type:             RESET_PASSWORD_TOKEN,
-		OneTimePasscode:  CreateOTP(user),
-		RegisteredClaims: makeDefaultClaimsWithTTL(tc.otpTokenTTL)}
+		RegisteredClaims: tc.registeredClaims(RESET_PASSWORD_TOKEN, user.Uuid, tc.otpTokenTTL)}
 
 	return tc.BaseToken(claims)
 }
 
 func (tc *TokenCreator) ResetEmailToken(c *gin.Context, user *AuthUser, email *mail.Address) (string, error) {
-
 	claims := TokenClaims{
 		UserId:           user.Uuid,
 		Data:             email.Address,
 		Type:             CHANGE_EMAIL_TOKEN,
-		OneTimePasscode:  CreateOTP(user),
-		RegisteredClaims: makeDefaultClaimsWithTTL(tc.otpTokenTTL)}
+		RegisteredClaims: tc.registeredClaims(CHANGE_EMAIL_TOKEN, user.Uuid, tc.otpTokenTTL)}
 
 	return tc.BaseToken(claims)
 
@@ -206,23 +374,33 @@ func (tc *TokenCreator) PasswordlessToken(c *gin.Context, userId string, redirec
 		// account page because then they have to click on the page they want again
 		// which is annoying UI.
 		RedirectUrl:      redirectUrl,
-		RegisteredClaims: makeDefaultClaimsWithTTL(tc.shortTTL),
+		RegisteredClaims: tc.registeredClaims(PASSWORDLESS_TOKEN, userId, tc.shortTTL),
 	}
 
 	return tc.BaseToken(claims)
 }
 
+// Short lived token for a one time action. Like the verify email,
+// reset password and change email tokens, it works once because
+// TokenVerifier.Redeem records its id, not because of a passcode.
 func (tc *TokenCreator) OTPToken(c *gin.Context, user *AuthUser, tokenType TokenType) (string, error) {
 	claims := TokenClaims{
 		UserId:           user.Uuid,
 		Type:             tokenType,
-		OneTimePasscode:  CreateOTP(user),
-		RegisteredClaims: makeDefaultClaimsWithTTL(tc.shortTTL),
+		RegisteredClaims: tc.registeredClaims(tokenType, user.Uuid, tc.shortTTL),
 	}
 
 	return tc.BaseToken(claims)
 }
 
+// Issued in place of the usual tokens when a user with mfa enabled
+// signs in with their password. The client sends it back with their
+// second factor, and it must be redeemed with TokenVerifier.Redeem
+// so it can only be used once.
+func (tc *TokenCreator) MfaPendingToken(c *gin.Context, user *AuthUser) (string, error) {
+	return tc.BasicToken(c, user.Uuid, MFA_PENDING_TOKEN, tc.shortTTL)
+}
+
 // Generate short lived tokens for one time passcode use.
 func (tc *TokenCreator) ShortTimeToken(c *gin.Context,
 	publicId string,
@@ -237,7 +415,7 @@ func (tc *TokenCreator) BasicToken(c *gin.Context,
 	claims := TokenClaims{
 		UserId:           publicId,
 		Type:             tokenType,
-		RegisteredClaims: makeDefaultClaimsWithTTL(ttl),
+		RegisteredClaims: tc.registeredClaims(tokenType, publicId, ttl),
 	}
 
 	return tc.BaseToken(claims)
@@ -245,24 +423,58 @@ func (tc *TokenCreator) BasicToken(c *gin.Context,
 
 func (tc *TokenCreator) BaseToken(claims jwt.Claims) (string, error) {
 
+	key := tc.keys.Current()
+
 	// Create token with claims
 	//token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+
+	// lets verifiers pick the right key after a rotation
+	token.Header["kid"] = key.Id
 
-	// Generate encoded token and send it as response.
-	t, err := token.SignedString(tc.secret)
+	ss, err := token.SigningString()
 
 	if err != nil {
 		return "", err
 	}
 
+	// sign ourselves rather than with token.SignedString so any
+	// crypto.Signer can be used, not just in memory private keys
+	sig, err := key.Sign(ss)
+
+	if err != nil {
+		return "", err
+	}
+
+	t := ss + "." + base64.RawURLEncoding.EncodeToString(sig)
+
 	//log.Debug().Msgf("token %s", t)
 
 	return t, nil
 }
 
-func makeDefaultClaimsWithTTL(ttl time.Duration) jwt.RegisteredClaims {
-	return jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl))}
+// store calls should be cancelled with the request
+func requestContext(c *gin.Context) context.Context {
+	if c == nil || c.Request == nil {
+		return context.Background()
+	}
+
+	return c.Request.Context()
+}
+
+// Every token gets a unique id (jti) so it can be revoked, and
+// says who issued it, who it is for and who it is about so it
+// cannot be used with another service sharing our keys
+func (tc *TokenCreator) registeredClaims(tokenType TokenType, subject string, ttl time.Duration) jwt.RegisteredClaims {
+	now := time.Now()
+
+	return jwt.RegisteredClaims{ID: uuid.NewString(),
+		Issuer:    tc.issuer,
+		Subject:   subject,
+		Audience:  tc.audiences[tokenType],
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl))}
 }
 
 // Get the unique permissions associated with a user based
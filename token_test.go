@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Issue an access token signed with signer and split it into the
+// signed part and the raw signature
+func testToken(t *testing.T, signer crypto.Signer, alg string) (string, []byte) {
+	t.Helper()
+
+	creator, err := NewTokenCreator(signer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := creator.AccessToken(nil, "ann", ROLE_USER)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &TokenClaims{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kid, _ := KeyId(signer.Public())
+
+	if parsed.Header["alg"] != alg || parsed.Header["kid"] != kid {
+		t.Fatalf("header is %v", parsed.Header)
+	}
+
+	i := strings.LastIndex(token, ".")
+
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// golang-jwt must accept it too
+	_, err = jwt.Parse(token,
+		func(token *jwt.Token) (any, error) { return signer.Public(), nil },
+		jwt.WithValidMethods([]string{alg}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token[:i], sig
+}
+
+func TestTokenCreatorES256(t *testing.T) {
+	signer := testSigners(t)[ES256]
+	publicKey := signer.Public().(*ecdsa.PublicKey)
+
+	signed, sig := testToken(t, signer, ES256)
+
+	// JWS uses r || s, not DER
+	if len(sig) != 64 {
+		t.Fatalf("signature is %d bytes", len(sig))
+	}
+
+	digest := sha256.Sum256([]byte(signed))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+
+	if !ecdsa.Verify(publicKey, digest[:], r, s) {
+		t.Fatal("signature does not match the public key")
+	}
+
+	other := testSigners(t)[ES256].Public().(*ecdsa.PublicKey)
+
+	if ecdsa.Verify(other, digest[:], r, s) {
+		t.Fatal("signature matches another key")
+	}
+}
+
+func TestTokenCreatorEdDSA(t *testing.T) {
+	signer := testSigners(t)[EDDSA]
+	publicKey := signer.Public().(ed25519.PublicKey)
+
+	signed, sig := testToken(t, signer, EDDSA)
+
+	if !ed25519.Verify(publicKey, []byte(signed), sig) {
+		t.Fatal("signature does not match the public key")
+	}
+
+	other := testSigners(t)[EDDSA].Public().(ed25519.PublicKey)
+
+	if ed25519.Verify(other, []byte(signed), sig) {
+		t.Fatal("signature matches another key")
+	}
+}
+
+func TestTokenVerifierAlgorithms(t *testing.T) {
+	for alg, signer := range testSigners(t) {
+		creator, err := NewTokenCreator(signer)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verifier, err := NewTokenVerifier(signer.Public())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := creator.AccessToken(nil, "ann", ROLE_USER)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		claims, err := verifier.Verify(t.Context(), token, ACCESS_TOKEN)
+
+		if err != nil || claims.UserId != "ann" {
+			t.Fatalf("%s: %v", alg, err)
+		}
+
+		// flip a bit in the signature
+		i := strings.LastIndex(token, ".")
+		sig, _ := base64.RawURLEncoding.DecodeString(token[i+1:])
+		sig[0] ^= 1
+
+		_, err = verifier.Verify(t.Context(), token[:i+1]+base64.RawURLEncoding.EncodeToString(sig), ACCESS_TOKEN)
+
+		if err == nil {
+			t.Fatalf("%s: tampered token was accepted", alg)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package tokengen
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"net/mail"
 	"sync"
 
@@ -10,18 +10,46 @@ import (
 )
 
 var tc *auth.TokenCreator
+var initErr error
 var once sync.Once
 
-func Init(secret *rsa.PrivateKey) {
+// Returns an error if the key cannot sign tokens
+func Init(secret crypto.Signer) error {
 	once.Do(func() {
-		tc = auth.NewTokenCreator(secret)
+		tc, initErr = auth.NewTokenCreator(secret)
 	})
+
+	return initErr
+}
+
+// The keys tokens are signed with, e.g. to publish them with
+// auth.JWKSHandler
+func KeyRing() *auth.KeyRing {
+	return tc.KeyRing()
+}
+
+func SetIssuer(issuer string) {
+	tc.SetIssuer(issuer)
+}
+
+func SetAudience(tokenType auth.TokenType, audience ...string) {
+	tc.SetAudience(tokenType, audience...)
+}
+
+// Must be called before issuing refresh tokens, e.g. with
+// userdbcache.Instance()
+func SetRefreshTokenStore(store auth.RefreshTokenStore) {
+	tc.SetRefreshTokenStore(store)
 }
 
 func RefreshToken(c *gin.Context, user *auth.AuthUser) (string, error) {
 	return tc.RefreshToken(c, user)
 }
 
+func RotateRefreshToken(c *gin.Context, claims *auth.TokenClaims) (string, error) {
+	return tc.RotateRefreshToken(c, claims)
+}
+
 func AccessToken(c *gin.Context, publicId string, roles string) (string, error) {
 	return tc.AccessToken(c, publicId, roles)
 }
@@ -42,6 +70,10 @@ func PasswordlessToken(c *gin.Context, userId string, url string) (string, error
 	return tc.PasswordlessToken(c, userId, url)
 }
 
+func MfaPendingToken(c *gin.Context, user *auth.AuthUser) (string, error) {
+	return tc.MfaPendingToken(c, user)
+}
+
 func OneTimeToken(c *gin.Context, user *auth.AuthUser, tokenType auth.TokenType) (string, error) {
 	return tc.OTPToken(c, user, tokenType)
 }
@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// RFC 6238 settings. These are the defaults every authenticator
+// app supports so we do not make them configurable.
+const (
+	TOTP_DIGITS       = 6
+	TOTP_PERIOD_SECS  = 30
+	TOTP_SECRET_BYTES = 20
+	// accept codes this many steps either side of now to allow for
+	// clock drift and slow typing
+	DEFAULT_TOTP_DRIFT = 1
+)
+
+var (
+	ErrTotpNotEnabled     = errors.New("totp is not enabled")
+	ErrTotpAlreadyEnabled = errors.New("totp is already enabled")
+	ErrTotpInvalidCode    = errors.New("totp code is invalid")
+	ErrTotpCodeReused     = errors.New("totp code has already been used")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// What a user needs to add us to their authenticator app. Show the
+// uri as a qr code, with the secret for manual entry.
+type TotpEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+}
+
+// The code for a secret at time t
+func TotpCode(secret []byte, t time.Time) string {
+	return totpCode(secret, totpStep(t))
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / TOTP_PERIOD_SECS
+}
+
+// RFC 4226 HOTP with the time step as the counter
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	// 10^TOTP_DIGITS
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%1000000)
+}
+
+// The time step a code matches within drift steps of t, or false
+// if it does not match
+func validateTotp(secret []byte, code string, t time.Time, drift uint) (int64, bool) {
+	now := totpStep(t)
+
+	for offset := -int64(drift); offset <= int64(drift); offset++ {
+		step := now + offset
+
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// The otpauth:// uri authenticator apps read from qr codes
+func TotpUri(issuer string, account string, secret []byte) string {
+	query := url.Values{}
+	query.Set("secret", totpEncoding.EncodeToString(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	query.Set("period", fmt.Sprint(TOTP_PERIOD_SECS))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Enrols users in totp two factor authentication and checks their
+// codes. Secrets are encrypted with cipher before they are stored.
+type TotpAuthenticator struct {
+	store    TotpStore
+	cipher   *SecretCipher
+	throttle *LoginThrottle
+	issuer   string
+	drift    uint
+}
+
+// issuer is the name shown in authenticator apps
+func NewTotpAuthenticator(store TotpStore, cipher *SecretCipher, issuer string) *TotpAuthenticator {
+	return &TotpAuthenticator{store: store,
+		cipher: cipher,
+		issuer: issuer,
+		drift:  DEFAULT_TOTP_DRIFT}
+}
+
+func (ta *TotpAuthenticator) SetDrift(steps uint) *TotpAuthenticator {
+	ta.drift = steps
+	return ta
+}
+
+// Needed to confirm and verify codes. Wrong codes are counted
+// against the user so they cannot be guessed.
+func (ta *TotpAuthenticator) SetLoginThrottle(throttle *LoginThrottle) *TotpAuthenticator {
+	ta.throttle = throttle
+	return ta
+}
+
+// Generate a new secret for the user. Totp is not enabled until the
+// user confirms they have added it to their app with a valid code.
+// Calling Enroll again before confirming replaces the secret.
+func (ta *TotpAuthenticator) Enroll(ctx context.Context, user *AuthUser) (*TotpEnrollment, error) {
+	totp, err := ta.store.FindTotp(ctx, user)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if totp != nil && totp.ConfirmedAt != 0 {
+		return nil, ErrTotpAlreadyEnabled
+	}
+
+	secret := make([]byte, TOTP_SECRET_BYTES)
+
+	_, err = rand.Read(secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := ta.cipher.Encrypt(secret, []byte(user.Uuid))
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = ta.store.SetTotpSecret(ctx, user, encrypted)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &TotpEnrollment{Secret: totpEncoding.EncodeToString(secret),
+		Uri: TotpUri(ta.issuer, user.Email, secret)}, nil
+}
+
+// Finish enrolment with a code from the user's app. Wrong codes are
+// throttled like in Verify.
+func (ta *TotpAuthenticator) Confirm(ctx context.Context, user *AuthUser, code string) error {
+	if ta.throttle == nil {
+		return fmt.Errorf("login throttle not set")
+	}
+
+	err := ta.throttle.CheckMfa(ctx, user)
+
+	if err != nil {
+		return err
+	}
+
+	totp, secret, err := ta.secret(ctx, user)
+
+	if err != nil {
+		return err
+	}
+
+	if totp.ConfirmedAt != 0 {
+		return ErrTotpAlreadyEnabled
+	}
+
+	step, ok := validateTotp(secret, code, time.Now(), ta.drift)
+
+	if !ok {
+		err = ta.throttle.FailMfa(ctx, user)
+
+		if err != nil {
+			return err
+		}
+
+		return ErrTotpInvalidCode
+	}
+
+	// the confirmation code counts as used
+	err = ta.store.ConfirmTotp(ctx, user, step)
+
+	if err != nil {
+		return err
+	}
+
+	return ta.throttle.SucceedMfa(ctx, user)
+}
+
+// Check a code as the second step of signing in. Each code can
+// only be used once, and once a code has been used older codes
+// are rejected too. Returns a *LoginLockedError without checking
+// the code if there have been too many wrong codes.
+func (ta *TotpAuthenticator) Verify(ctx context.Context, user *AuthUser, code string) error {
+	if ta.throttle == nil {
+		return fmt.Errorf("login throttle not set")
+	}
+
+	err := ta.throttle.CheckMfa(ctx, user)
+
+	if err != nil {
+		return err
+	}
+
+	totp, secret, err := ta.secret(ctx, user)
+
+	if err != nil {
+		return err
+	}
+
+	if totp.ConfirmedAt == 0 {
+		return ErrTotpNotEnabled
+	}
+
+	step, ok := validateTotp(secret, code, time.Now(), ta.drift)
+
+	if !ok {
+		err = ta.throttle.FailMfa(ctx, user)
+
+		if err != nil {
+			return err
+		}
+
+		return ErrTotpInvalidCode
+	}
+
+	ok, err = ta.store.UseTotpStep(ctx, user, step)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrTotpCodeReused
+	}
+
+	return ta.throttle.SucceedMfa(ctx, user)
+}
+
+func (ta *TotpAuthenticator) Disable(ctx context.Context, user *AuthUser) error {
+	return ta.store.DeleteTotp(ctx, user)
+}
+
+func (ta *TotpAuthenticator) secret(ctx context.Context, user *AuthUser) (*TotpRecord, []byte, error) {
+	totp, err := ta.store.FindTotp(ctx, user)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrTotpNotEnabled
+		}
+
+		return nil, nil, err
+	}
+
+	secret, err := ta.cipher.Decrypt(totp.Secret, []byte(user.Uuid))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return totp, secret, nil
+}
@@ -0,0 +1,256 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA1, with the last 6 of the 8 digits
+func TestTotpCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	tests := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for unix, want := range tests {
+		if got := TotpCode(secret, time.Unix(unix, 0)); got != want {
+			t.Errorf("%d: got %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestValidateTotpDrift(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	step := totpStep(now)
+
+	tests := []struct {
+		offset time.Duration
+		drift  uint
+		ok     bool
+	}{
+		{0, 0, true},
+		{-TOTP_PERIOD_SECS * time.Second, 0, false},
+		{-TOTP_PERIOD_SECS * time.Second, 1, true},
+		{TOTP_PERIOD_SECS * time.Second, 1, true},
+		{-2 * TOTP_PERIOD_SECS * time.Second, 1, false},
+		{2 * TOTP_PERIOD_SECS * time.Second, 1, false},
+		{-2 * TOTP_PERIOD_SECS * time.Second, 2, true},
+	}
+
+	for _, test := range tests {
+		code := TotpCode(secret, now.Add(test.offset))
+
+		matched, ok := validateTotp(secret, code, now, test.drift)
+
+		if ok != test.ok {
+			t.Errorf("offset %s, drift %d: expected %v", test.offset, test.drift, test.ok)
+		}
+
+		if ok && matched != step+int64(test.offset/(TOTP_PERIOD_SECS*time.Second)) {
+			t.Errorf("offset %s: matched step %d", test.offset, matched)
+		}
+	}
+
+	_, ok := validateTotp(secret, "abcdef", now, 1)
+
+	if ok {
+		t.Error("accepted a code that is not a number")
+	}
+}
+
+type totpTest struct {
+	ctx    context.Context
+	db     *MemUserDb
+	ta     *TotpAuthenticator
+	user   *AuthUser
+	secret []byte
+}
+
+// A user enrolled but not yet confirmed
+func newTotpTest(t *testing.T) *totpTest {
+	t.Helper()
+
+	ctx := context.Background()
+	db, user := newTestUser(t)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	cipher, err := NewSecretCipher(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	throttle := NewLoginThrottle(db).
+		SetMaxFailures(3).
+		SetSecurityEventHandler(func(ctx context.Context, event *SecurityEvent) {})
+
+	ta := NewTotpAuthenticator(db, cipher, "Example").SetLoginThrottle(throttle)
+
+	enrollment, err := ta.Enroll(ctx, user)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := totpEncoding.DecodeString(enrollment.Secret)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &totpTest{ctx: ctx, db: db, ta: ta, user: user, secret: secret}
+}
+
+func (tt *totpTest) code(offset time.Duration) string {
+	return TotpCode(tt.secret, time.Now().Add(offset))
+}
+
+func TestTotpConfirmAndVerify(t *testing.T) {
+	tt := newTotpTest(t)
+
+	err := tt.ta.Verify(tt.ctx, tt.user, tt.code(0))
+
+	if !errors.Is(err, ErrTotpNotEnabled) {
+		t.Fatalf("before confirming: %v", err)
+	}
+
+	err = tt.ta.Confirm(tt.ctx, tt.user, tt.code(-TOTP_PERIOD_SECS*time.Second))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tt.ta.Confirm(tt.ctx, tt.user, tt.code(0))
+
+	if !errors.Is(err, ErrTotpAlreadyEnabled) {
+		t.Fatalf("confirmed twice: %v", err)
+	}
+
+	// the confirmation code is used up
+	err = tt.ta.Verify(tt.ctx, tt.user, tt.code(-TOTP_PERIOD_SECS*time.Second))
+
+	if !errors.Is(err, ErrTotpCodeReused) {
+		t.Fatalf("confirmation code reused: %v", err)
+	}
+
+	err = tt.ta.Verify(tt.ctx, tt.user, tt.code(0))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTotpReplay(t *testing.T) {
+	tt := newTotpTest(t)
+
+	err := tt.ta.Confirm(tt.ctx, tt.user, tt.code(-TOTP_PERIOD_SECS*time.Second))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := tt.code(TOTP_PERIOD_SECS * time.Second)
+
+	err = tt.ta.Verify(tt.ctx, tt.user, next)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tt.ta.Verify(tt.ctx, tt.user, next)
+
+	if !errors.Is(err, ErrTotpCodeReused) {
+		t.Fatalf("same code twice: %v", err)
+	}
+
+	// an older code still in the drift window is refused once a
+	// newer one has been used
+	err = tt.ta.Verify(tt.ctx, tt.user, tt.code(0))
+
+	if !errors.Is(err, ErrTotpCodeReused) {
+		t.Fatalf("older code: %v", err)
+	}
+
+	err = tt.ta.Verify(tt.ctx, tt.user, tt.code(5*time.Minute))
+
+	if !errors.Is(err, ErrTotpInvalidCode) {
+		t.Fatalf("code outside the drift window: %v", err)
+	}
+}
+
+func TestTotpConfirmThrottled(t *testing.T) {
+	tt := newTotpTest(t)
+
+	for range 3 {
+		err := tt.ta.Confirm(tt.ctx, tt.user, "000000")
+
+		if !errors.Is(err, ErrTotpInvalidCode) && !errors.Is(err, ErrLoginLocked) {
+			t.Fatalf("wrong code: %v", err)
+		}
+	}
+
+	// locked, so even the right code is refused
+	err := tt.ta.Confirm(tt.ctx, tt.user, tt.code(0))
+
+	if !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("expected ErrLoginLocked, got %v", err)
+	}
+
+	err = NewLoginThrottle(tt.db).Unlock(tt.ctx, tt.user)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tt.ta.Confirm(tt.ctx, tt.user, tt.code(0))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTotpVerifyThrottled(t *testing.T) {
+	tt := newTotpTest(t)
+
+	err := tt.ta.Confirm(tt.ctx, tt.user, tt.code(-TOTP_PERIOD_SECS*time.Second))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		tt.ta.Verify(tt.ctx, tt.user, "000000")
+	}
+
+	err = tt.ta.Verify(tt.ctx, tt.user, tt.code(0))
+
+	if !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("expected ErrLoginLocked, got %v", err)
+	}
+
+	if tt.user.UnlockAt <= time.Now().Unix() {
+		t.Fatal("UnlockAt was not set")
+	}
+}
+
+func TestTotpNeedsThrottle(t *testing.T) {
+	tt := newTotpTest(t)
+
+	tt.ta.SetLoginThrottle(nil)
+
+	if tt.ta.Confirm(tt.ctx, tt.user, tt.code(0)) == nil {
+		t.Fatal("confirmed without a throttle")
+	}
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// A user's totp authenticator. Secret is encrypted, see SecretCipher.
+// Times are unix seconds and ConfirmedAt is 0 until enrolment is
+// confirmed.
+type TotpRecord struct {
+	UserId      uint
+	Secret      string
+	CreatedAt   int64
+	ConfirmedAt int64
+	// time step of the last code accepted
+	LastStep int64
+}
+
+type TotpStore interface {
+	// Start enrolment with a new secret, replacing any existing one
+	SetTotpSecret(ctx context.Context, user *AuthUser, secret string) error
+	FindTotp(ctx context.Context, user *AuthUser) (*TotpRecord, error)
+	ConfirmTotp(ctx context.Context, user *AuthUser, step int64) error
+	// Record that the code for step was used. Returns false if a code
+	// for the same or a later step has already been used.
+	UseTotpStep(ctx context.Context, user *AuthUser, step int64) (bool, error)
+	DeleteTotp(ctx context.Context, user *AuthUser) error
+}
+
+const INSERT_TOTP_SQL = `INSERT INTO user_totp (user_id, secret, created_at) VALUES (?, ?, ?)`
+
+const FIND_TOTP_SQL = `SELECT
+	user_id, secret, created_at, confirmed_at, last_step
+	FROM user_totp
+	WHERE user_id = ?`
+
+const CONFIRM_TOTP_SQL = `UPDATE user_totp SET confirmed_at = ?, last_step = ? WHERE user_id = ?`
+
+const USE_TOTP_STEP_SQL = `UPDATE user_totp SET last_step = ? WHERE user_id = ? AND confirmed_at > 0 AND last_step < ?`
+
+const DELETE_TOTP_SQL = `DELETE FROM user_totp WHERE user_id = ?`
+
+const USERS_MFA_SQL string = `SELECT
+	user_totp.user_id, 'totp'
+	FROM user_totp
+	WHERE user_totp.confirmed_at > 0 AND user_totp.user_id IN (%s)`
+
+func (userdb *UserDb) SetTotpSecret(ctx context.Context, user *AuthUser, secret string) error {
+	return userdb.withTx(ctx, func(tx *UserDb) error {
+		_, err := tx.exec(ctx, DELETE_TOTP_SQL, user.Id)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.exec(ctx, INSERT_TOTP_SQL, user.Id, secret, time.Now().Unix())
+
+		return err
+	})
+}
+
+func (userdb *UserDb) FindTotp(ctx context.Context, user *AuthUser) (*TotpRecord, error) {
+	var totp TotpRecord
+
+	err := userdb.queryRow(ctx, FIND_TOTP_SQL, user.Id).Scan(&totp.UserId,
+		&totp.Secret,
+		&totp.CreatedAt,
+		&totp.ConfirmedAt,
+		&totp.LastStep)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &totp, nil
+}
+
+func (userdb *UserDb) ConfirmTotp(ctx context.Context, user *AuthUser, step int64) error {
+	_, err := userdb.exec(ctx, CONFIRM_TOTP_SQL, time.Now().Unix(), step, user.Id)
+
+	return err
+}
+
+func (userdb *UserDb) UseTotpStep(ctx context.Context, user *AuthUser, step int64) (bool, error) {
+	result, err := userdb.exec(ctx, USE_TOTP_STEP_SQL, step, user.Id, step)
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (userdb *UserDb) DeleteTotp(ctx context.Context, user *AuthUser) error {
+	_, err := userdb.exec(ctx, DELETE_TOTP_SQL, user.Id)
+
+	return err
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"os"
+
+	"github.com/antonybholmes/go-sys"
+	"github.com/go-sql-driver/mysql"
+)
+
+var MYSQL_DIALECT = &SqlDialect{
+	Name:           "mysql",
+	driver:         "mysql",
+	selectUsersSql: SELECT_USERS_SQL,
+	// the driver needs multiStatements=true to run scripts
+	// so split them instead
+	splitStatements: true,
+}
+
+// Create a MySQL backed user db from the MYSQL_* env variables
+func NewUserDB() *UserDb {
+	//db := sys.Must(sql.Open("sqlite3", file))
+	cfg := mysql.Config{
+		User:                 os.Getenv("MYSQL_USER"),
+		Passwd:               os.Getenv("MYSQL_PASSWORD"),
+		Net:                  "tcp",
+		Addr:                 os.Getenv("MYSQL_ADDR"),
+		DBName:               os.Getenv("MYSQL_DATABASE"),
+		AllowNativePasswords: true,
+	}
+
+	return sys.Must(OpenUserDB(MYSQL_DIALECT, cfg.FormatDSN()))
+}
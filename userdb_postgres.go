@@ -0,0 +1,29 @@
+package auth
+
+import (
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// Postgres has no TO_SECONDS so we add the seconds between
+// year 0 and the unix epoch to match MySQL
+const POSTGRES_SELECT_USERS_SQL string = `SELECT 
+	id, 
+	uuid, 
+	first_name, 
+	last_name, 
+	username, 
+	email, 
+	is_locked, 
+	password, 
+	FLOOR(EXTRACT(EPOCH FROM email_verified_at))::BIGINT + 62167219200 as email_verified_at, 
+	FLOOR(EXTRACT(EPOCH FROM created_at))::BIGINT + 62167219200 as created_at, 
+	FLOOR(EXTRACT(EPOCH FROM updated_at))::BIGINT + 62167219200 as updated_at
+	FROM users`
+
+var POSTGRES_DIALECT = &SqlDialect{
+	Name:             "postgres",
+	driver:           "pgx",
+	selectUsersSql:   POSTGRES_SELECT_USERS_SQL,
+	onConflictIgnore: true,
+	numberedParams:   true,
+}
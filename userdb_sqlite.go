@@ -0,0 +1,29 @@
+package auth
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite has no TO_SECONDS so we add the seconds between
+// year 0 and the unix epoch to match MySQL
+const SQLITE_SELECT_USERS_SQL string = `SELECT 
+	id, 
+	uuid, 
+	first_name, 
+	last_name, 
+	username, 
+	email, 
+	is_locked, 
+	password, 
+	CAST(strftime('%s', email_verified_at) AS INTEGER) + 62167219200 as email_verified_at, 
+	CAST(strftime('%s', created_at) AS INTEGER) + 62167219200 as created_at, 
+	CAST(strftime('%s', updated_at) AS INTEGER) + 62167219200 as updated_at
+	FROM users`
+
+var SQLITE_DIALECT = &SqlDialect{
+	Name:             "sqlite",
+	driver:           "sqlite3",
+	selectUsersSql:   SQLITE_SELECT_USERS_SQL,
+	onConflictIgnore: true,
+	noRowLocks:       true,
+}
@@ -1,6 +1,7 @@
 package userdbcache
 
 import (
+	"context"
 	"net/mail"
 	"sync"
 
@@ -8,7 +9,7 @@ import (
 )
 
 // pretend its a global const
-var instance *auth.UserDb
+var instance auth.UserStore
 var once sync.Once
 
 func InitCache() {
@@ -21,10 +22,33 @@ func InitCache() {
 
 }
 
-func Instance() *auth.UserDb {
+// Init the cache with a database selected by dsn,
+// e.g. sqlite://users.db
+func InitCacheFromDSN(dsn string) error {
+	var err error
+
+	once.Do(func() {
+		instance, err = auth.NewUserDBFromDSN(dsn)
+	})
+
+	return err
+}
+
+// Init the cache with any store, e.g. for tests
+func InitCacheWithStore(store auth.UserStore) {
+	once.Do(func() {
+		instance = store
+	})
+}
+
+func Instance() auth.UserStore {
 	return instance
 }
 
+// Every query takes a context so that deadlines and client disconnects
+// cancel database work. In gin handlers pass c.Request.Context(), since
+// gin.Context only forwards cancellation when ContextWithFallback is set.
+
 // func NewConn() (*sql.DB, error) {
 // 	return instance.NewConn()
 // }
@@ -33,54 +57,74 @@ func Instance() *auth.UserDb {
 // 	return instance.AutoConn(db)
 // }
 
-func NumUsers() (uint, error) {
-	return instance.NumUsers()
+func NumUsers(ctx context.Context) (uint, error) {
+	return instance.NumUsers(ctx)
+}
+
+func Roles(ctx context.Context) ([]*auth.Role, error) {
+	return instance.Roles(ctx)
 }
 
-func Roles() ([]*auth.Role, error) {
-	return instance.Roles()
+func Users(ctx context.Context, records uint, offset uint, opts ...auth.UserOption) ([]*auth.AuthUser, error) {
+	return instance.Users(ctx, records, offset, opts...)
 }
 
-func Users(records uint, offset uint) ([]*auth.AuthUser, error) {
-	return instance.Users(records, offset)
+func QueryUsers(ctx context.Context, query *auth.UserQuery, opts ...auth.UserOption) ([]*auth.AuthUser, error) {
+	return instance.QueryUsers(ctx, query, opts...)
 }
 
-func CreateUserFromSignup(user *auth.LoginBodyReq) (*auth.AuthUser, error) {
-	return instance.CreateUserFromSignup(user)
+func CountUsers(ctx context.Context, query *auth.UserQuery) (uint, error) {
+	return instance.CountUsers(ctx, query)
 }
 
-func CreateUserFromAuth0(name string, email *mail.Address) (*auth.AuthUser, error) {
-	return instance.CreateUserFromAuth0(name, email)
+func UsersPage(ctx context.Context, query *auth.UserQuery, cursor string, opts ...auth.UserOption) (*auth.Page[*auth.AuthUser], error) {
+	return instance.UsersPage(ctx, query, cursor, opts...)
 }
 
-func FindUserById(id uint) (*auth.AuthUser, error) {
-	return instance.FindUserById(id)
+func RolesPage(ctx context.Context, records uint, cursor string) (*auth.Page[*auth.Role], error) {
+	return instance.RolesPage(ctx, records, cursor)
 }
 
-func FindUserByUuid(uuid string) (*auth.AuthUser, error) {
-	return instance.FindUserByUuid(uuid)
+func UserApiKeysPage(ctx context.Context, user *auth.AuthUser, records uint, cursor string) (*auth.Page[string], error) {
+	return instance.UserApiKeysPage(ctx, user, records, cursor)
 }
 
-func FindUserByUsername(username string) (*auth.AuthUser, error) {
-	return instance.FindUserByUsername(username)
+func CreateUserFromSignup(ctx context.Context, user *auth.LoginBodyReq) (*auth.AuthUser, error) {
+	return instance.CreateUserFromSignup(ctx, user)
 }
 
-func FindUserByApiKey(key string) (*auth.AuthUser, error) {
-	return instance.FindUserByApiKey(key)
+func CreateUserFromAuth0(ctx context.Context, name string, email *mail.Address) (*auth.AuthUser, error) {
+	return instance.CreateUserFromAuth0(ctx, name, email)
 }
 
-func FindUserByEmail(email *mail.Address) (*auth.AuthUser, error) {
-	return instance.FindUserByEmail(email)
+func FindUserById(ctx context.Context, id uint, opts ...auth.UserOption) (*auth.AuthUser, error) {
+	return instance.FindUserById(ctx, id, opts...)
 }
 
-func UserRoles(user *auth.AuthUser) ([]*auth.Role, error) {
-	return instance.UserRoles(user)
+func FindUserByUuid(ctx context.Context, uuid string, opts ...auth.UserOption) (*auth.AuthUser, error) {
+	return instance.FindUserByUuid(ctx, uuid, opts...)
+}
+
+func FindUserByUsername(ctx context.Context, username string, opts ...auth.UserOption) (*auth.AuthUser, error) {
+	return instance.FindUserByUsername(ctx, username, opts...)
+}
+
+func FindUserByApiKey(ctx context.Context, key string, opts ...auth.UserOption) (*auth.AuthUser, error) {
+	return instance.FindUserByApiKey(ctx, key, opts...)
+}
+
+func FindUserByEmail(ctx context.Context, email *mail.Address, opts ...auth.UserOption) (*auth.AuthUser, error) {
+	return instance.FindUserByEmail(ctx, email, opts...)
+}
+
+func UserRoles(ctx context.Context, user *auth.AuthUser) ([]*auth.Role, error) {
+	return instance.UserRoles(ctx, user)
 }
 
 // returns a string list of a user's roles
-func UserRoleList(user *auth.AuthUser) ([]string, error) {
+func UserRoleList(ctx context.Context, user *auth.AuthUser) ([]string, error) {
 
-	roles, err := instance.UserRoles(user)
+	roles, err := instance.UserRoles(ctx, user)
 
 	if err != nil {
 		return nil, err
@@ -96,12 +140,12 @@ func UserRoleList(user *auth.AuthUser) ([]string, error) {
 	return ret, nil
 }
 
-func UserPermissions(user *auth.AuthUser) ([]*auth.Permission, error) {
-	return instance.UserPermissions(user)
+func UserPermissions(ctx context.Context, user *auth.AuthUser) ([]*auth.Permission, error) {
+	return instance.UserPermissions(ctx, user)
 }
 
-func PermissionList(user *auth.AuthUser) ([]string, error) {
-	return instance.PermissionList(user)
+func PermissionList(ctx context.Context, user *auth.AuthUser) ([]string, error) {
+	return instance.PermissionList(ctx, user)
 }
 
 // func PublicUserRolePermissions(user *auth.AuthUser) (*[]auth.PublicRole, error) {
@@ -136,12 +180,16 @@ func PermissionList(user *auth.AuthUser) ([]string, error) {
 
 // }
 
-func SetIsVerified(user string) error {
-	return instance.SetIsVerified(user)
+func SetIsVerified(ctx context.Context, user string) error {
+	return instance.SetIsVerified(ctx, user)
+}
+
+func VerifyPassword(ctx context.Context, user *auth.AuthUser, password string) error {
+	return instance.VerifyPassword(ctx, user, password)
 }
 
-func SetPassword(user *auth.AuthUser, password string) error {
-	return instance.SetPassword(user, password)
+func SetPassword(ctx context.Context, user *auth.AuthUser, password string) error {
+	return instance.SetPassword(ctx, user, password)
 }
 
 // func SetUsername(publicId string, username string) error {
@@ -152,22 +200,27 @@ func SetPassword(user *auth.AuthUser, password string) error {
 // 	return instance.SetName(publicId, firstName, lastName)
 // }
 
-func SetUserInfo(user *auth.AuthUser, username string, firstName string, lastName string, adminMode bool) error {
-	return instance.SetUserInfo(user, username, firstName, lastName, adminMode)
+func SetUserInfo(ctx context.Context, user *auth.AuthUser, username string, firstName string, lastName string, adminMode bool) error {
+	return instance.SetUserInfo(ctx, user, username, firstName, lastName, adminMode)
 }
 
 // func SetEmail(publicId string, email string) error {
 // 	return instance.SetEmail(publicId, email)
 // }
 
-func SetEmailAddress(user *auth.AuthUser, address *mail.Address, adminMode bool) error {
-	return instance.SetEmailAddress(user, address, adminMode)
+func SetEmailAddress(ctx context.Context, user *auth.AuthUser, address *mail.Address, adminMode bool) error {
+	return instance.SetEmailAddress(ctx, user, address, adminMode)
+}
+
+func SetUserRoles(ctx context.Context, user *auth.AuthUser, roles []string, adminMode bool) error {
+	return instance.SetUserRoles(ctx, user, roles, adminMode)
 }
 
-func SetUserRoles(user *auth.AuthUser, roles []string, adminMode bool) error {
-	return instance.SetUserRoles(user, roles, adminMode)
+// Run several user changes atomically
+func WithTx(ctx context.Context, fn func(tx auth.UserStore) error) error {
+	return instance.WithTx(ctx, fn)
 }
 
-func DeleteUser(publicId string) error {
-	return instance.DeleteUser(publicId)
+func DeleteUser(ctx context.Context, publicId string) error {
+	return instance.DeleteUser(ctx, publicId)
 }
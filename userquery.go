@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type UserSort = string
+
+const (
+	SORT_BY_NAME     UserSort = "name"
+	SORT_BY_USERNAME UserSort = "username"
+	SORT_BY_EMAIL    UserSort = "email"
+	SORT_BY_CREATED  UserSort = "created"
+	SORT_BY_UPDATED  UserSort = "updated"
+)
+
+// Wrapping the select in a derived table lets us filter and
+// sort on the dates after they have been converted to seconds
+const QUERY_USERS_SQL string = `SELECT * FROM (` + SELECT_USERS_SQL + `) AS users`
+
+const COUNT_QUERY_USERS_SQL string = `SELECT COUNT(*) FROM (` + SELECT_USERS_SQL + `) AS users`
+
+const USERS_WITH_ROLE_SQL string = `users.id IN (SELECT users_roles.user_id
+	FROM users_roles, roles
+	WHERE roles.id = users_roles.role_id AND roles.name = ?)`
+
+// ! rather than \ so the escape is the same in every dialect
+const LIKE_ESCAPE = "!"
+
+// Filters for listing users in an admin dashboard. Nil or
+// empty fields do not filter.
+type UserQuery struct {
+	// Matched case insensitively against first name,
+	// last name, username and email
+	Search        string   `json:"search" form:"search"`
+	Role          string   `json:"role" form:"role"`
+	IsLocked      *bool    `json:"isLocked" form:"isLocked"`
+	EmailVerified *bool    `json:"emailVerified" form:"emailVerified"`
+	SortBy        UserSort `json:"sortBy" form:"sortBy"`
+	Descending    bool     `json:"desc" form:"desc"`
+	// at most MAX_PAGE_RECORDS, 0 for DEFAULT_PAGE_RECORDS
+	Records uint `json:"records" form:"records"`
+	Offset  uint `json:"offset" form:"offset"`
+}
+
+// Users matching the query, with their roles
+func (userdb *UserDb) QueryUsers(ctx context.Context, query *UserQuery, opts ...UserOption) ([]*AuthUser, error) {
+	where, args, err := query.where()
+
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := query.orderBy()
+
+	if err != nil {
+		return nil, err
+	}
+
+	records := pageRecords(query.Records)
+
+	args = append(args, records, query.Offset)
+
+	rows, err := userdb.query(ctx, QUERY_USERS_SQL+where+order+` LIMIT ? OFFSET ?`, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	authUsers := make([]*AuthUser, 0, records)
+
+	for rows.Next() {
+		authUser, err := scanUser(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		authUsers = append(authUsers, authUser)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = userdb.addRelations(ctx, authUsers, NewUserOptions(false, opts...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return authUsers, nil
+}
+
+// A page of users matching the query. Offset is ignored, instead
+// the cursor from the previous page selects where to continue.
+// Records is the page size.
+func (userdb *UserDb) UsersPage(ctx context.Context, query *UserQuery, cursor string, opts ...UserOption) (*Page[*AuthUser], error) {
+	where, args, err := query.where()
+
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := query.sortColumns()
+
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := decodeCursor(query.cursorKind(), cursor)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if after != nil {
+		if len(after) != len(columns) {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+
+		keyset := keysetClause(columns, query.Descending)
+
+		if where == "" {
+			where = " WHERE " + keyset
+		} else {
+			where += " AND " + keyset
+		}
+
+		args = append(args, after...)
+	}
+
+	order, err := query.orderBy()
+
+	if err != nil {
+		return nil, err
+	}
+
+	records := pageRecords(query.Records)
+
+	// fetch one more than needed to know if there is a next page
+	args = append(args, records+1)
+
+	rows, err := userdb.query(ctx, QUERY_USERS_SQL+where+order+` LIMIT ?`, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	authUsers := make([]*AuthUser, 0, records+1)
+
+	for rows.Next() {
+		authUser, err := scanUser(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		authUsers = append(authUsers, authUser)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := makePage(query.cursorKind(), authUsers, records, query.sortValues)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = userdb.addRelations(ctx, page.Items, NewUserOptions(false, opts...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// The number of users matching the query ignoring paging
+func (userdb *UserDb) CountUsers(ctx context.Context, query *UserQuery) (uint, error) {
+	where, args, err := query.where()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint
+
+	err = userdb.queryRow(ctx, COUNT_QUERY_USERS_SQL+where, args...).Scan(&n)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (query *UserQuery) where() (string, []any, error) {
+	clauses := make([]string, 0, 4)
+	args := make([]any, 0, 8)
+
+	search := strings.TrimSpace(query.Search)
+
+	if search != "" {
+		pattern := "%" + escapeLike(strings.ToLower(search)) + "%"
+
+		clauses = append(clauses, `(LOWER(users.first_name) LIKE ? ESCAPE '!' OR
+			LOWER(users.last_name) LIKE ? ESCAPE '!' OR
+			LOWER(users.username) LIKE ? ESCAPE '!' OR
+			LOWER(users.email) LIKE ? ESCAPE '!')`)
+
+		args = append(args, pattern, pattern, pattern, pattern)
+	}
+
+	if query.Role != "" {
+		clauses = append(clauses, USERS_WITH_ROLE_SQL)
+		args = append(args, query.Role)
+	}
+
+	if query.IsLocked != nil {
+		clauses = append(clauses, `users.is_locked = ?`)
+		args = append(args, *query.IsLocked)
+	}
+
+	if query.EmailVerified != nil {
+		if *query.EmailVerified {
+			clauses = append(clauses, `users.email_verified_at > ?`)
+		} else {
+			clauses = append(clauses, `users.email_verified_at <= ?`)
+		}
+
+		args = append(args, int64(EMAIL_NOT_VERIFIED_TIME_S))
+	}
+
+	if len(clauses) == 0 {
+		return "", args, nil
+	}
+
+	return " WHERE " + strings.Join(clauses, " AND "), args, nil
+}
+
+func (query *UserQuery) orderBy() (string, error) {
+	columns, err := query.sortColumns()
+
+	if err != nil {
+		return "", err
+	}
+
+	dir := " ASC"
+
+	if query.Descending {
+		dir = " DESC"
+	}
+
+	order := make([]string, len(columns))
+
+	for ci, column := range columns {
+		order[ci] = column + dir
+	}
+
+	return " ORDER BY " + strings.Join(order, ", "), nil
+}
+
+// Sort columns are whitelisted since they cannot be passed
+// as parameters. The id is added so paging is stable when
+// values are equal.
+func (query *UserQuery) sortColumns() ([]string, error) {
+	switch query.SortBy {
+	case SORT_BY_NAME, "":
+		return []string{"users.first_name", "users.last_name", "users.email", "users.id"}, nil
+	case SORT_BY_USERNAME:
+		return []string{"users.username", "users.id"}, nil
+	case SORT_BY_EMAIL:
+		return []string{"users.email", "users.id"}, nil
+	case SORT_BY_CREATED:
+		return []string{"users.created_at", "users.id"}, nil
+	case SORT_BY_UPDATED:
+		return []string{"users.updated_at", "users.id"}, nil
+	default:
+		return nil, fmt.Errorf("cannot sort users by %s", query.SortBy)
+	}
+}
+
+// The values of a user matching sortColumns
+func (query *UserQuery) sortValues(user *AuthUser) []any {
+	id := int64(user.Id)
+
+	switch query.SortBy {
+	case SORT_BY_USERNAME:
+		return []any{user.Username, id}
+	case SORT_BY_EMAIL:
+		return []any{user.Email, id}
+	case SORT_BY_CREATED:
+		return []any{int64(user.CreatedAt), id}
+	case SORT_BY_UPDATED:
+		return []any{int64(user.UpdatedAt), id}
+	default:
+		return []any{user.FirstName, user.LastName, user.Email, id}
+	}
+}
+
+// cursors are tied to the sort order they were made with
+func (query *UserQuery) cursorKind() string {
+	sortBy := query.SortBy
+
+	if sortBy == "" {
+		sortBy = SORT_BY_NAME
+	}
+
+	return fmt.Sprintf("users:%s:%t", sortBy, query.Descending)
+}
+
+func escapeLike(s string) string {
+	s = strings.ReplaceAll(s, LIKE_ESCAPE, LIKE_ESCAPE+LIKE_ESCAPE)
+	s = strings.ReplaceAll(s, "%", LIKE_ESCAPE+"%")
+	return strings.ReplaceAll(s, "_", LIKE_ESCAPE+"_")
+}
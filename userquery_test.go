@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"fmt"
+	"net/mail"
+	"testing"
+)
+
+func TestPageRecords(t *testing.T) {
+	tests := map[uint]uint{
+		0:                    DEFAULT_PAGE_RECORDS,
+		1:                    1,
+		250:                  250,
+		MAX_PAGE_RECORDS:     MAX_PAGE_RECORDS,
+		MAX_PAGE_RECORDS + 1: MAX_PAGE_RECORDS,
+	}
+
+	for records, want := range tests {
+		if got := pageRecords(records); got != want {
+			t.Errorf("%d: got %d, want %d", records, got, want)
+		}
+	}
+}
+
+// Every way of listing users treats 0 records the same
+func TestListingsDefaultRecords(t *testing.T) {
+	db := NewMemUserDB()
+
+	n := int(DEFAULT_PAGE_RECORDS) + 20
+
+	for i := range n {
+		email, _ := mail.ParseAddress(fmt.Sprintf("user%03d@example.org", i))
+
+		// passwordless so there is nothing to hash
+		_, err := db.CreateUser(t.Context(), fmt.Sprintf("user%03d", i), email, "", "User", "Smith", true)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users, err := db.Users(t.Context(), 0, 0)
+
+	if err != nil || len(users) != int(DEFAULT_PAGE_RECORDS) {
+		t.Fatalf("Users: got %d: %v", len(users), err)
+	}
+
+	users, err = db.QueryUsers(t.Context(), &UserQuery{})
+
+	if err != nil || len(users) != int(DEFAULT_PAGE_RECORDS) {
+		t.Fatalf("QueryUsers: got %d: %v", len(users), err)
+	}
+
+	page, err := db.UsersPage(t.Context(), &UserQuery{}, "")
+
+	if err != nil || len(page.Items) != int(DEFAULT_PAGE_RECORDS) || page.NextCursor == "" {
+		t.Fatalf("UsersPage: got %d: %v", len(page.Items), err)
+	}
+
+	users, err = db.Users(t.Context(), MAX_PAGE_RECORDS+1, 0)
+
+	if err != nil || len(users) != n {
+		t.Fatalf("Users: got %d: %v", len(users), err)
+	}
+
+	users, err = db.Users(t.Context(), 5, uint(n-2))
+
+	if err != nil || len(users) != 2 {
+		t.Fatalf("Users with an offset: got %d: %v", len(users), err)
+	}
+}
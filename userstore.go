@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+	"net/mail"
+)
+
+// Everything an app needs from a user database. UserDb implements it
+// for MySQL, SQLite and Postgres.
+type UserStore interface {
+	// refresh tokens live alongside the users they belong to
+	RefreshTokenStore
+	RevocationStore
+	ConsumedTokenStore
+	TotpStore
+	RecoveryCodeStore
+	WebAuthnStore
+	LoginFailureStore
+
+	NumUsers(ctx context.Context) (uint, error)
+	Users(ctx context.Context, records uint, offset uint, opts ...UserOption) ([]*AuthUser, error)
+	DeleteUser(ctx context.Context, uuid string) error
+
+	// Search, filter and sort users, see UserQuery
+	QueryUsers(ctx context.Context, query *UserQuery, opts ...UserOption) ([]*AuthUser, error)
+	CountUsers(ctx context.Context, query *UserQuery) (uint, error)
+
+	// Keyset paginated listings, pass the NextCursor of one page
+	// to get the next
+	UsersPage(ctx context.Context, query *UserQuery, cursor string, opts ...UserOption) (*Page[*AuthUser], error)
+	RolesPage(ctx context.Context, records uint, cursor string) (*Page[*Role], error)
+	UserApiKeysPage(ctx context.Context, user *AuthUser, records uint, cursor string) (*Page[string], error)
+
+	FindUserByEmail(ctx context.Context, email *mail.Address, opts ...UserOption) (*AuthUser, error)
+	FindUserByUsername(ctx context.Context, username string, opts ...UserOption) (*AuthUser, error)
+	FindUserById(ctx context.Context, id uint, opts ...UserOption) (*AuthUser, error)
+	FindUserByUuid(ctx context.Context, uuid string, opts ...UserOption) (*AuthUser, error)
+	FindUserByApiKey(ctx context.Context, key string, opts ...UserOption) (*AuthUser, error)
+
+	AddRolesToUser(ctx context.Context, authUser *AuthUser) error
+	UserRoleList(ctx context.Context, user *AuthUser) ([]string, error)
+	AddApiKeysToUser(ctx context.Context, authUser *AuthUser) error
+	UserApiKeys(ctx context.Context, user *AuthUser) ([]string, error)
+	UserRoles(ctx context.Context, user *AuthUser) ([]*Role, error)
+	PermissionList(ctx context.Context, user *AuthUser) ([]string, error)
+	UserPermissions(ctx context.Context, user *AuthUser) ([]*Permission, error)
+	Roles(ctx context.Context) ([]*Role, error)
+	FindRoleByName(ctx context.Context, name string) (*Role, error)
+
+	SetIsVerified(ctx context.Context, userId string) error
+	// Check a password on sign in, upgrading its hash if needed
+	VerifyPassword(ctx context.Context, user *AuthUser, password string) error
+	SetPassword(ctx context.Context, user *AuthUser, password string) error
+	SetUserInfo(ctx context.Context, user *AuthUser, username string, firstName string, lastName string, adminMode bool) error
+	SetEmailAddress(ctx context.Context, user *AuthUser, address *mail.Address, adminMode bool) error
+	SetUserRoles(ctx context.Context, user *AuthUser, roles []string, adminMode bool) error
+	AddRoleToUser(ctx context.Context, user *AuthUser, roleName string, adminMode bool) error
+	CreateApiKeyForUser(ctx context.Context, user *AuthUser, adminMode bool) error
+
+	CreateUserFromSignup(ctx context.Context, user *LoginBodyReq) (*AuthUser, error)
+	CreateUserFromAuth0(ctx context.Context, name string, email *mail.Address) (*AuthUser, error)
+	CreateUser(ctx context.Context, userName string,
+		email *mail.Address,
+		password string,
+		firstName string,
+		lastName string,
+		emailIsVerified bool) (*AuthUser, error)
+
+	// Run fn atomically, see UserDb.WithTx
+	WithTx(ctx context.Context, fn func(tx UserStore) error) error
+
+	Close() error
+}
+
+// Controls which related records are loaded along with users
+type UserOptions struct {
+	ApiKeys bool
+}
+
+type UserOption func(options *UserOptions)
+
+// Single user lookups load api keys by default, listings do not
+func WithApiKeys(apiKeys bool) UserOption {
+	return func(options *UserOptions) {
+		options.ApiKeys = apiKeys
+	}
+}
+
+func NewUserOptions(apiKeys bool, opts ...UserOption) *UserOptions {
+	options := &UserOptions{ApiKeys: apiKeys}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return options
+}
+
+var _ UserStore = (*UserDb)(nil)
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrTokenExpired          = errors.New("token has expired")
+	ErrTokenWrongType        = errors.New("token is not the expected type")
+	ErrTokenInvalidSignature = errors.New("token signature is invalid")
+	ErrTokenInvalid          = errors.New("token is invalid")
+	ErrTokenRevoked          = errors.New("token has been revoked")
+	ErrTokenWrongIssuer      = errors.New("token was not issued by the expected issuer")
+	ErrTokenWrongAudience    = errors.New("token is not intended for this audience")
+	ErrTokenNotYetValid      = errors.New("token is not valid yet")
+	ErrTokenMustBeRedeemed   = errors.New("token can only be used once and must be redeemed")
+)
+
+// Verifies tokens minted by a TokenCreator using the public half
+// of the key pair the creator signs with
+type TokenVerifier struct {
+	keys        KeySource
+	revocations RevocationStore
+	consumed    ConsumedTokenStore
+	issuer      string
+	audiences   map[TokenType]string
+	leeway      time.Duration
+}
+
+// Verify tokens signed by a single rsa, P-256 or ed25519 key.
+// Returns an error for any other kind of key.
+func NewTokenVerifier(publicKey crypto.PublicKey) (*TokenVerifier, error) {
+	keys, err := NewVerificationKeyRing(publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTokenVerifierWithKeyRing(keys), nil
+}
+
+// Verify tokens signed by any key in the ring, e.g. the ring of the
+// TokenCreator in the same app so rotations are seen immediately
+func NewTokenVerifierWithKeyRing(keys *KeyRing) *TokenVerifier {
+	return NewTokenVerifierWithKeySource(keys)
+}
+
+// Verify tokens issued by another service using the keys it
+// publishes at a JWKS url
+func NewRemoteTokenVerifier(url string) *TokenVerifier {
+	return NewTokenVerifierWithKeySource(NewJWKSClient(url))
+}
+
+func NewTokenVerifierWithKeySource(keys KeySource) *TokenVerifier {
+	return &TokenVerifier{keys: keys,
+		issuer:    os.Getenv("TOKEN_ISSUER"),
+		audiences: make(map[TokenType]string)}
+}
+
+// Needed to redeem one time tokens
+func (tv *TokenVerifier) SetConsumedTokenStore(store ConsumedTokenStore) *TokenVerifier {
+	tv.consumed = store
+	return tv
+}
+
+// Only accept tokens from this issuer. Empty accepts any issuer.
+func (tv *TokenVerifier) SetIssuer(issuer string) *TokenVerifier {
+	tv.issuer = issuer
+	return tv
+}
+
+// Tokens of the given type must list audience, i.e. us, in their
+// aud claim
+func (tv *TokenVerifier) SetAudience(tokenType TokenType, audience string) *TokenVerifier {
+	tv.audiences[tokenType] = audience
+	return tv
+}
+
+// Allow for clocks differing between servers when checking the
+// exp, nbf and iat claims
+func (tv *TokenVerifier) SetLeeway(leeway time.Duration) *TokenVerifier {
+	tv.leeway = leeway
+	return tv
+}
+
+// Once set, tokens must have an id (jti) and tokens revoked in
+// the store are rejected
+func (tv *TokenVerifier) SetRevocationStore(store RevocationStore) *TokenVerifier {
+	tv.revocations = store
+	return tv
+}
+
+// Parse a token and check its signature and expiry, and that it has
+// not been revoked. Tokens must be signed with the algorithm of
+// the key they name, so an attacker cannot pick a weaker one.
+func (tv *TokenVerifier) Parse(ctx context.Context, tokenString string) (*TokenClaims, error) {
+	claims := TokenClaims{}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods([]string{RS256, ES256, EDDSA}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(tv.leeway)}
+
+	if tv.issuer != "" {
+		options = append(options, jwt.WithIssuer(tv.issuer))
+	}
+
+	_, err := jwt.ParseWithClaims(tokenString,
+		&claims,
+		func(token *jwt.Token) (any, error) {
+			return tv.key(ctx, token)
+		},
+		options...)
+
+	if err != nil {
+		return nil, tokenError(err)
+	}
+
+	// audiences depend on the token type so can only be
+	// checked once we have the claims
+	audience, ok := tv.audiences[claims.Type]
+
+	if ok && !slices.Contains(claims.Audience, audience) {
+		return nil, ErrTokenWrongAudience
+	}
+
+	if tv.revocations != nil {
+		if claims.ID == "" {
+			return nil, fmt.Errorf("%w: token has no id", ErrTokenInvalid)
+		}
+
+		revoked, err := tv.revocations.IsTokenRevoked(ctx, claims.ID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	return &claims, nil
+}
+
+// Pick the key named by the kid header. Tokens issued before kids
+// were added are checked against the default key.
+func (tv *TokenVerifier) key(ctx context.Context, token *jwt.Token) (any, error) {
+	id := ""
+
+	kid, ok := token.Header["kid"]
+
+	if ok {
+		id, ok = kid.(string)
+
+		if !ok {
+			return nil, fmt.Errorf("kid is not a string")
+		}
+	}
+
+	key, err := tv.keys.VerificationKey(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("key %s cannot be used with %s", key.Id, token.Method.Alg())
+	}
+
+	return key.PublicKey, nil
+}
+
+// Tokens that can only be used once so must be checked with Redeem
+var oneTimeTokens = []TokenType{VERIFY_EMAIL_TOKEN,
+	PASSWORDLESS_TOKEN,
+	RESET_PASSWORD_TOKEN,
+	CHANGE_EMAIL_TOKEN,
+	OTP_TOKEN,
+	MFA_PENDING_TOKEN}
+
+// Parse a token and check it is of the expected type, e.g. a
+// refresh token cannot be used where an access token is required.
+// One time tokens, such as reset password and mfa_pending tokens,
+// are refused with ErrTokenMustBeRedeemed and must be checked with
+// Redeem instead so they cannot be replayed.
+func (tv *TokenVerifier) Verify(ctx context.Context, tokenString string, tokenType TokenType) (*TokenClaims, error) {
+	if slices.Contains(oneTimeTokens, tokenType) {
+		return nil, ErrTokenMustBeRedeemed
+	}
+
+	return tv.verify(ctx, tokenString, tokenType)
+}
+
+func (tv *TokenVerifier) verify(ctx context.Context, tokenString string, tokenType TokenType) (*TokenClaims, error) {
+	claims, err := tv.Parse(ctx, tokenString)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Type != tokenType {
+		return nil, ErrTokenWrongType
+	}
+
+	return claims, nil
+}
+
+// Verify a one time token, such as a passwordless sign in or reset
+// password token, and mark it as used in the same step. Redeeming a
+// token a second time fails with ErrTokenAlreadyUsed.
+func (tv *TokenVerifier) Redeem(ctx context.Context, tokenString string, expectedType TokenType) (*TokenClaims, error) {
+	if tv.consumed == nil {
+		return nil, fmt.Errorf("consumed token store not set")
+	}
+
+	claims, err := tv.verify(ctx, tokenString, expectedType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ID == "" {
+		return nil, fmt.Errorf("%w: token has no id", ErrTokenInvalid)
+	}
+
+	ok, err := tv.consumed.ConsumeToken(ctx, claims.ID, claims.Type, claims.ExpiresAt.Unix())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrTokenAlreadyUsed
+	}
+
+	return claims, nil
+}
+
+// Revoke a token so it is rejected from now on, e.g. when a user
+// signs out or a reset link has been used
+func (tv *TokenVerifier) Revoke(ctx context.Context, claims *TokenClaims) error {
+	if tv.revocations == nil {
+		return fmt.Errorf("revocation store not set")
+	}
+
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return fmt.Errorf("%w: token has no id", ErrTokenInvalid)
+	}
+
+	return tv.revocations.RevokeToken(ctx, claims.ID, claims.ExpiresAt.Unix())
+}
+
+// map jwt errors onto our own so callers do not need to
+// depend on the jwt library to work out what went wrong
+func tokenError(err error) error {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet),
+		errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return ErrTokenNotYetValid
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return ErrTokenWrongIssuer
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid),
+		errors.Is(err, jwt.ErrTokenUnverifiable):
+		return ErrTokenInvalidSignature
+	default:
+		return fmt.Errorf("%w: %w", ErrTokenInvalid, err)
+	}
+}
@@ -0,0 +1,416 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Vectors for an ed25519 passkey on example.org using the RFC 8032
+// test 1 key, so the assertion signature is deterministic
+
+const WEBAUTHN_TEST_RP_ID = "example.org"
+const WEBAUTHN_TEST_ORIGIN = "https://example.org"
+
+// sha256 of example.org
+const WEBAUTHN_TEST_RP_ID_HASH_HEX = "bfabc37432958b063360d3ad6461c9c4735ae7f8edd46592a5e0f01452b2e4b5"
+
+const WEBAUTHN_TEST_SEED_HEX = "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60"
+
+// 16 byte credential id 000102...0f
+const WEBAUTHN_TEST_CREDENTIAL_ID = "AAECAwQFBgcICQoLDA0ODw"
+
+// base64url of "registration-challenge"
+const WEBAUTHN_TEST_REGISTRATION_CHALLENGE = "cmVnaXN0cmF0aW9uLWNoYWxsZW5nZQ"
+
+// base64url of "login-challenge"
+const WEBAUTHN_TEST_LOGIN_CHALLENGE = "bG9naW4tY2hhbGxlbmdl"
+
+const WEBAUTHN_TEST_REGISTRATION_CLIENT_DATA = `{"type":"webauthn.create","challenge":"cmVnaXN0cmF0aW9uLWNoYWxsZW5nZQ","origin":"https://example.org"}`
+
+const WEBAUTHN_TEST_LOGIN_CLIENT_DATA = `{"type":"webauthn.get","challenge":"bG9naW4tY2hhbGxlbmdl","origin":"https://example.org"}`
+
+// {"fmt": "none", "attStmt": {}, "authData": ...}
+const WEBAUTHN_TEST_ATTESTATION_HEX = "a3 63 666d74 64 6e6f6e65 67 61747453746d74 a0 68 6175746844617461 58 71" +
+	// rp id hash, flags UP UV AT, sign count 0
+	" " + WEBAUTHN_TEST_RP_ID_HASH_HEX + " 45 00000000" +
+	// aaguid, credential id length and id
+	" 00000000000000000000000000000000 0010 000102030405060708090a0b0c0d0e0f" +
+	" " + COSE_EDDSA_KEY_HEX
+
+// rp id hash, flags UP UV, sign count 1
+const WEBAUTHN_TEST_AUTH_DATA_HEX = WEBAUTHN_TEST_RP_ID_HASH_HEX + " 05 00000001"
+
+// ed25519 over the auth data and sha256 of the login client data
+const WEBAUTHN_TEST_SIGNATURE_HEX = "42b31a0bd6e155a6009c92488402ba4c35075af9f1fbf7b424c6873cfbd887b2" +
+	"91483c71f6983e3550933d6a880aefe4752c21f1c275a25704727295520d1a0e"
+
+func b64url(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func newWebAuthnTest(t *testing.T) (context.Context, *MemUserDb, *WebAuthn, *AuthUser) {
+	t.Helper()
+
+	ctx := context.Background()
+	db := NewMemUserDB()
+
+	email, _ := mail.ParseAddress("ann@example.org")
+
+	user, err := db.CreateUser(ctx, "ann", email, "correct horse battery staple", "Ann", "Smith", true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wa := NewWebAuthn(db, WEBAUTHN_TEST_RP_ID, "Example").
+		SetSecurityEventHandler(func(ctx context.Context, event *SecurityEvent) {})
+
+	return ctx, db, wa, user
+}
+
+func addWebAuthnChallenge(t *testing.T, ctx context.Context, db *MemUserDb, id string, userId uint, ceremony string) {
+	t.Helper()
+
+	err := db.AddWebAuthnChallenge(ctx, &WebAuthnChallenge{Id: id,
+		UserId:    userId,
+		Ceremony:  ceremony,
+		ExpiresAt: time.Now().Add(time.Minute).Unix()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func registerTestPasskey(t *testing.T, ctx context.Context, db *MemUserDb, wa *WebAuthn, user *AuthUser) *WebAuthnCredential {
+	t.Helper()
+
+	addWebAuthnChallenge(t, ctx, db, WEBAUTHN_TEST_REGISTRATION_CHALLENGE, user.Id, WEBAUTHN_REGISTRATION)
+
+	req := WebAuthnRegistrationReq{Id: WEBAUTHN_TEST_CREDENTIAL_ID, Type: "public-key", Name: "laptop"}
+	req.Response.ClientDataJSON = b64url([]byte(WEBAUTHN_TEST_REGISTRATION_CLIENT_DATA))
+	req.Response.AttestationObject = b64url(mustHex(t, WEBAUTHN_TEST_ATTESTATION_HEX))
+
+	credential, err := wa.FinishRegistration(ctx, user, &req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return credential
+}
+
+// Sign an assertion with the test key for a new login challenge
+func testAssertion(t *testing.T, ctx context.Context, db *MemUserDb, flags byte, signCount uint32) *WebAuthnAssertionReq {
+	t.Helper()
+
+	challenge := b64url([]byte(t.Name() + time.Now().String()))
+
+	addWebAuthnChallenge(t, ctx, db, challenge, 0, WEBAUTHN_LOGIN)
+
+	clientData, _ := json.Marshal(webAuthnClientData{Type: "webauthn.get", Challenge: challenge, Origin: WEBAUTHN_TEST_ORIGIN})
+
+	authData := append(mustHex(t, WEBAUTHN_TEST_RP_ID_HASH_HEX), flags)
+	authData = binary.BigEndian.AppendUint32(authData, signCount)
+
+	hash := sha256.Sum256(clientData)
+	key := ed25519.NewKeyFromSeed(mustHex(t, WEBAUTHN_TEST_SEED_HEX))
+
+	req := WebAuthnAssertionReq{Id: WEBAUTHN_TEST_CREDENTIAL_ID, Type: "public-key"}
+	req.Response.ClientDataJSON = b64url(clientData)
+	req.Response.AuthenticatorData = b64url(authData)
+	req.Response.Signature = b64url(ed25519.Sign(key, append(authData, hash[:]...)))
+
+	return &req
+}
+
+func TestWebAuthnRegistrationVector(t *testing.T) {
+	ctx, db, wa, user := newWebAuthnTest(t)
+
+	credential := registerTestPasskey(t, ctx, db, wa, user)
+
+	if credential.Id != WEBAUTHN_TEST_CREDENTIAL_ID || credential.UserId != user.Id || credential.SignCount != 0 || credential.Name != "laptop" {
+		t.Fatalf("got %+v", credential)
+	}
+
+	if credential.PublicKey != b64url(mustHex(t, COSE_EDDSA_KEY_HEX)) {
+		t.Fatalf("wrong public key %s", credential.PublicKey)
+	}
+}
+
+func TestWebAuthnAssertionVector(t *testing.T) {
+	ctx, db, wa, user := newWebAuthnTest(t)
+
+	registerTestPasskey(t, ctx, db, wa, user)
+
+	addWebAuthnChallenge(t, ctx, db, WEBAUTHN_TEST_LOGIN_CHALLENGE, 0, WEBAUTHN_LOGIN)
+
+	req := WebAuthnAssertionReq{Id: WEBAUTHN_TEST_CREDENTIAL_ID, Type: "public-key"}
+	req.Response.ClientDataJSON = b64url([]byte(WEBAUTHN_TEST_LOGIN_CLIENT_DATA))
+	req.Response.AuthenticatorData = b64url(mustHex(t, WEBAUTHN_TEST_AUTH_DATA_HEX))
+	req.Response.Signature = b64url(mustHex(t, WEBAUTHN_TEST_SIGNATURE_HEX))
+	req.Response.UserHandle = webAuthnUserHandle(user)
+
+	signedIn, err := wa.FinishLogin(ctx, &req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signedIn.Uuid != user.Uuid {
+		t.Fatalf("signed in as %s", signedIn.Uuid)
+	}
+
+	credential, _ := db.FindWebAuthnCredential(ctx, WEBAUTHN_TEST_CREDENTIAL_ID)
+
+	if credential.SignCount != 1 || credential.LastUsedAt == 0 {
+		t.Fatalf("credential not updated %+v", credential)
+	}
+
+	// the challenge is used up
+	_, err = wa.FinishLogin(ctx, &req)
+
+	if !errors.Is(err, ErrWebAuthnChallenge) {
+		t.Fatalf("replay: %v", err)
+	}
+}
+
+// RFC 8032 test 1 and RFC 6979 A.2.5 with SHA-256 and "sample",
+// DER encoded as webauthn does
+func TestVerifyWebAuthnSignature(t *testing.T) {
+	edKey := ed25519.PublicKey(mustHex(t, "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"))
+	edSig := mustHex(t, "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b")
+
+	if !verifyWebAuthnSignature(edKey, EDDSA, []byte{}, edSig) {
+		t.Error("ed25519 vector did not verify")
+	}
+
+	if verifyWebAuthnSignature(edKey, EDDSA, []byte{0}, edSig) {
+		t.Error("ed25519 signature verified the wrong data")
+	}
+
+	ecKey := &ecdsa.PublicKey{Curve: elliptic.P256(),
+		X: new(big.Int).SetBytes(mustHex(t, "60FED4BA255A9D31C961EB74C6356D68C049B8923B61FA6CE669622E60F29FB6")),
+		Y: new(big.Int).SetBytes(mustHex(t, "7903FE1008B8BC99A41AE9E95628BC64F2F1B20C2D7E9F5177A3C294D4462299"))}
+
+	// SEQUENCE { INTEGER r, INTEGER s }, both need a leading 0 as
+	// their top bit is set
+	ecSig := mustHex(t, "3046"+
+		"022100EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716"+
+		"022100F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8")
+
+	if !verifyWebAuthnSignature(ecKey, ES256, []byte("sample"), ecSig) {
+		t.Error("P-256 vector did not verify")
+	}
+
+	if verifyWebAuthnSignature(ecKey, ES256, []byte("test"), ecSig) {
+		t.Error("P-256 signature verified the wrong data")
+	}
+
+	// jwts use raw r || s but webauthn does not
+	if verifyWebAuthnSignature(ecKey, ES256, []byte("sample"), ecSig[8:]) {
+		t.Error("P-256 accepted a signature that is not DER")
+	}
+}
+
+func TestWebAuthnAuthData(t *testing.T) {
+	_, _, wa, _ := newWebAuthnTest(t)
+
+	rpIdHash := WEBAUTHN_TEST_RP_ID_HASH_HEX
+	otherHash := strings.Repeat("00", 32)
+
+	tests := []struct {
+		name     string
+		hex      string
+		required bool
+		ok       bool
+	}{
+		{"present and verified", rpIdHash + "05 00000001", false, true},
+		{"present only", rpIdHash + "01 00000001", false, true},
+		{"verification required", rpIdHash + "05 00000001", true, true},
+		{"bad rp id hash", otherHash + "05 00000001", false, false},
+		{"missing UP", rpIdHash + "04 00000001", false, false},
+		{"missing UV when required", rpIdHash + "01 00000001", true, false},
+		{"too short", rpIdHash + "05 000000", false, false},
+		{"attested data missing", rpIdHash + "45 00000000", false, false},
+		{"credential id past end", rpIdHash + "45 00000000 00000000000000000000000000000000 0020 0001", false, false},
+		{"truncated key", WEBAUTHN_TEST_ATTESTATION_HEX[strings.Index(WEBAUTHN_TEST_ATTESTATION_HEX, rpIdHash) : len(WEBAUTHN_TEST_ATTESTATION_HEX)-2], false, false},
+	}
+
+	for _, test := range tests {
+		wa.SetUserVerificationRequired(test.required)
+
+		_, err := wa.authData(mustHex(t, test.hex))
+
+		if test.ok && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+
+		if !test.ok && !errors.Is(err, ErrWebAuthnInvalid) {
+			t.Errorf("%s: expected ErrWebAuthnInvalid, got %v", test.name, err)
+		}
+	}
+}
+
+func TestWebAuthnRegistrationInvalid(t *testing.T) {
+	attestation := WEBAUTHN_TEST_ATTESTATION_HEX
+
+	tests := map[string]string{
+		"truncated":         attestation[:len(attestation)-10],
+		"oversized length":  strings.Replace(attestation, "58 71", "59 ffff", 1),
+		"not a map":         "83 01 02 03",
+		"none with stmt":    strings.Replace(attestation, "a0", "a1 63 616c67 26", 1),
+		"bad rp id hash":    strings.Replace(attestation, WEBAUTHN_TEST_RP_ID_HASH_HEX, strings.Repeat("00", 32), 1),
+		"missing UP":        strings.Replace(attestation, " 45 ", " 44 ", 1),
+		"no attested data":  strings.Replace(attestation, " 45 ", " 05 ", 1),
+		"unsupported key":   strings.Replace(attestation, "03 27", "03 26", 1),
+		"nested too deeply": strings.Repeat("81", CBOR_MAX_DEPTH+2) + "00",
+	}
+
+	for name, s := range tests {
+		ctx, db, wa, user := newWebAuthnTest(t)
+
+		addWebAuthnChallenge(t, ctx, db, WEBAUTHN_TEST_REGISTRATION_CHALLENGE, user.Id, WEBAUTHN_REGISTRATION)
+
+		req := WebAuthnRegistrationReq{Id: WEBAUTHN_TEST_CREDENTIAL_ID, Type: "public-key"}
+		req.Response.ClientDataJSON = b64url([]byte(WEBAUTHN_TEST_REGISTRATION_CLIENT_DATA))
+		req.Response.AttestationObject = b64url(mustHex(t, s))
+
+		_, err := wa.FinishRegistration(ctx, user, &req)
+
+		if !errors.Is(err, ErrWebAuthnInvalid) {
+			t.Errorf("%s: expected ErrWebAuthnInvalid, got %v", name, err)
+		}
+
+		_, err = db.FindWebAuthnCredential(ctx, WEBAUTHN_TEST_CREDENTIAL_ID)
+
+		if err == nil {
+			t.Errorf("%s: credential was saved", name)
+		}
+	}
+}
+
+func TestWebAuthnLoginInvalid(t *testing.T) {
+	ctx, db, wa, user := newWebAuthnTest(t)
+
+	registerTestPasskey(t, ctx, db, wa, user)
+
+	req := testAssertion(t, ctx, db, 0x04, 1)
+
+	_, err := wa.FinishLogin(ctx, req)
+
+	if !errors.Is(err, ErrWebAuthnInvalid) {
+		t.Errorf("missing UP: %v", err)
+	}
+
+	req = testAssertion(t, ctx, db, 0x05, 1)
+	signature, _ := decodeBase64Url(req.Response.Signature)
+	signature[0] ^= 1
+	req.Response.Signature = b64url(signature)
+
+	_, err = wa.FinishLogin(ctx, req)
+
+	if !errors.Is(err, ErrWebAuthnInvalid) {
+		t.Errorf("bad signature: %v", err)
+	}
+
+	req = testAssertion(t, ctx, db, 0x05, 1)
+	req.Response.UserHandle = b64url([]byte("someone else"))
+
+	_, err = wa.FinishLogin(ctx, req)
+
+	if !errors.Is(err, ErrWebAuthnInvalid) {
+		t.Errorf("wrong user handle: %v", err)
+	}
+
+	req = testAssertion(t, ctx, db, 0x05, 1)
+	clientData := strings.Replace(WEBAUTHN_TEST_LOGIN_CLIENT_DATA, WEBAUTHN_TEST_ORIGIN, "https://evil.org", 1)
+	req.Response.ClientDataJSON = b64url([]byte(clientData))
+
+	_, err = wa.FinishLogin(ctx, req)
+
+	if !errors.Is(err, ErrWebAuthnInvalid) {
+		t.Errorf("wrong origin: %v", err)
+	}
+}
+
+func TestWebAuthnSignCount(t *testing.T) {
+	ctx, db, wa, user := newWebAuthnTest(t)
+
+	registerTestPasskey(t, ctx, db, wa, user)
+
+	_, err := wa.FinishLogin(ctx, testAssertion(t, ctx, db, 0x05, 5))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same count again or a lower one suggests a cloned
+	// authenticator
+	for _, count := range []uint32{5, 4, 0} {
+		_, err = wa.FinishLogin(ctx, testAssertion(t, ctx, db, 0x05, count))
+
+		if !errors.Is(err, ErrWebAuthnSignCount) {
+			t.Errorf("count %d: expected ErrWebAuthnSignCount, got %v", count, err)
+		}
+	}
+
+	_, err = wa.FinishLogin(ctx, testAssertion(t, ctx, db, 0x05, 6))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, _ := db.FindWebAuthnCredential(ctx, WEBAUTHN_TEST_CREDENTIAL_ID)
+
+	if credential.SignCount != 6 {
+		t.Fatalf("sign count is %d", credential.SignCount)
+	}
+}
+
+func TestWebAuthnSignCountOk(t *testing.T) {
+	tests := []struct {
+		stored    uint32
+		signCount uint32
+		ok        bool
+	}{
+		{0, 0, true},
+		{0, 1, true},
+		{1, 2, true},
+		{1, 1, false},
+		{2, 1, false},
+		{1, 0, false},
+	}
+
+	for _, test := range tests {
+		if webAuthnSignCountOk(test.stored, test.signCount) != test.ok {
+			t.Errorf("stored %d, sign count %d: expected %v", test.stored, test.signCount, test.ok)
+		}
+	}
+}
+
+func TestWebAuthnTestVectorsAreConsistent(t *testing.T) {
+	hash := sha256.Sum256([]byte(WEBAUTHN_TEST_RP_ID))
+
+	if hex.EncodeToString(hash[:]) != WEBAUTHN_TEST_RP_ID_HASH_HEX {
+		t.Fatal("rp id hash")
+	}
+
+	key := ed25519.NewKeyFromSeed(mustHex(t, WEBAUTHN_TEST_SEED_HEX))
+
+	if !strings.HasSuffix(COSE_EDDSA_KEY_HEX, hex.EncodeToString(key.Public().(ed25519.PublicKey))) {
+		t.Fatal("public key")
+	}
+}
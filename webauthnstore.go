@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// A passkey a user has registered. Id and PublicKey are base64url
+// encoded, the key being the COSE key from the authenticator. Times
+// are unix seconds.
+type WebAuthnCredential struct {
+	Id         string `json:"id"`
+	UserId     uint   `json:"-"`
+	PublicKey  string `json:"-"`
+	SignCount  uint32 `json:"-"`
+	Name       string `json:"name"`
+	CreatedAt  int64  `json:"createdAt"`
+	LastUsedAt int64  `json:"lastUsedAt"`
+}
+
+// An outstanding challenge. UserId is 0 for sign ins where the user
+// is found from the passkey.
+type WebAuthnChallenge struct {
+	Id        string
+	UserId    uint
+	Ceremony  string
+	ExpiresAt int64
+}
+
+type WebAuthnStore interface {
+	AddWebAuthnChallenge(ctx context.Context, challenge *WebAuthnChallenge) error
+	// Delete a challenge and return it so it can only be used once.
+	// Returns sql.ErrNoRows if it does not exist or was already used.
+	ConsumeWebAuthnChallenge(ctx context.Context, id string) (*WebAuthnChallenge, error)
+	DeleteExpiredWebAuthnChallenges(ctx context.Context, now int64) error
+
+	AddWebAuthnCredential(ctx context.Context, credential *WebAuthnCredential) error
+	FindWebAuthnCredential(ctx context.Context, id string) (*WebAuthnCredential, error)
+	UserWebAuthnCredentials(ctx context.Context, user *AuthUser) ([]*WebAuthnCredential, error)
+	// Record a sign in with a credential. Returns false if signCount
+	// has not gone up since the last sign in, unless the
+	// authenticator does not use a counter and both are 0.
+	UseWebAuthnCredential(ctx context.Context, id string, signCount uint32, usedAt int64) (bool, error)
+	DeleteWebAuthnCredential(ctx context.Context, user *AuthUser, id string) error
+}
+
+const INSERT_WEBAUTHN_CHALLENGE_SQL = `INSERT INTO webauthn_challenges (id, user_id, ceremony, expires_at) VALUES (?, ?, ?, ?)`
+
+const FIND_WEBAUTHN_CHALLENGE_SQL = `SELECT id, user_id, ceremony, expires_at FROM webauthn_challenges WHERE id = ?`
+
+const DELETE_WEBAUTHN_CHALLENGE_SQL = `DELETE FROM webauthn_challenges WHERE id = ?`
+
+const DELETE_EXPIRED_WEBAUTHN_CHALLENGES_SQL = `DELETE FROM webauthn_challenges WHERE expires_at < ?`
+
+// challenges have no foreign key since discoverable logins have no
+// user yet
+const DELETE_USER_WEBAUTHN_CHALLENGES_SQL = `DELETE FROM webauthn_challenges WHERE user_id = ?`
+
+const INSERT_WEBAUTHN_CREDENTIAL_SQL = `INSERT INTO webauthn_credentials
+	(id, user_id, public_key, sign_count, name, created_at)
+	VALUES (?, ?, ?, ?, ?, ?)`
+
+const SELECT_WEBAUTHN_CREDENTIAL_SQL = `SELECT
+	id, user_id, public_key, sign_count, name, created_at, last_used_at
+	FROM webauthn_credentials`
+
+const FIND_WEBAUTHN_CREDENTIAL_SQL = SELECT_WEBAUTHN_CREDENTIAL_SQL + ` WHERE id = ?`
+
+const USER_WEBAUTHN_CREDENTIALS_SQL = SELECT_WEBAUTHN_CREDENTIAL_SQL + ` WHERE user_id = ? ORDER BY created_at, id`
+
+// locks the credential so it cannot be deleted or used by another
+// sign in until we have updated it
+const WEBAUTHN_SIGN_COUNT_SQL = `SELECT sign_count FROM webauthn_credentials WHERE id = ? FOR UPDATE`
+
+// only if the count has not changed since we read it, so two sign
+// ins with the same count cannot both succeed
+const USE_WEBAUTHN_CREDENTIAL_SQL = `UPDATE webauthn_credentials
+	SET sign_count = ?, last_used_at = ?
+	WHERE id = ? AND sign_count = ?`
+
+const DELETE_WEBAUTHN_CREDENTIAL_SQL = `DELETE FROM webauthn_credentials WHERE user_id = ? AND id = ?`
+
+const USERS_WEBAUTHN_SQL string = `SELECT
+	webauthn_credentials.user_id, 'webauthn'
+	FROM webauthn_credentials
+	WHERE webauthn_credentials.user_id IN (%s)`
+
+func (userdb *UserDb) AddWebAuthnChallenge(ctx context.Context, challenge *WebAuthnChallenge) error {
+	_, err := userdb.exec(ctx, INSERT_WEBAUTHN_CHALLENGE_SQL,
+		challenge.Id,
+		challenge.UserId,
+		challenge.Ceremony,
+		challenge.ExpiresAt)
+
+	if err != nil {
+		return err
+	}
+
+	// challenges that are never answered are cleared out here
+	return userdb.DeleteExpiredWebAuthnChallenges(ctx, time.Now().Unix())
+}
+
+func (userdb *UserDb) ConsumeWebAuthnChallenge(ctx context.Context, id string) (*WebAuthnChallenge, error) {
+	var challenge WebAuthnChallenge
+
+	err := userdb.queryRow(ctx, FIND_WEBAUTHN_CHALLENGE_SQL, id).Scan(&challenge.Id,
+		&challenge.UserId,
+		&challenge.Ceremony,
+		&challenge.ExpiresAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := userdb.exec(ctx, DELETE_WEBAUTHN_CHALLENGE_SQL, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := result.RowsAffected()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// someone else used it between the select and the delete
+	if n != 1 {
+		return nil, sql.ErrNoRows
+	}
+
+	return &challenge, nil
+}
+
+func (userdb *UserDb) DeleteExpiredWebAuthnChallenges(ctx context.Context, now int64) error {
+	_, err := userdb.exec(ctx, DELETE_EXPIRED_WEBAUTHN_CHALLENGES_SQL, now)
+
+	return err
+}
+
+func (userdb *UserDb) AddWebAuthnCredential(ctx context.Context, credential *WebAuthnCredential) error {
+	_, err := userdb.exec(ctx, INSERT_WEBAUTHN_CREDENTIAL_SQL,
+		credential.Id,
+		credential.UserId,
+		credential.PublicKey,
+		int64(credential.SignCount),
+		credential.Name,
+		credential.CreatedAt)
+
+	return err
+}
+
+func (userdb *UserDb) FindWebAuthnCredential(ctx context.Context, id string) (*WebAuthnCredential, error) {
+	return scanWebAuthnCredential(userdb.queryRow(ctx, FIND_WEBAUTHN_CREDENTIAL_SQL, id))
+}
+
+func (userdb *UserDb) UserWebAuthnCredentials(ctx context.Context, user *AuthUser) ([]*WebAuthnCredential, error) {
+	rows, err := userdb.query(ctx, USER_WEBAUTHN_CREDENTIALS_SQL, user.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	credentials := make([]*WebAuthnCredential, 0, 4)
+
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, rows.Err()
+}
+
+func (userdb *UserDb) UseWebAuthnCredential(ctx context.Context, id string, signCount uint32, usedAt int64) (bool, error) {
+	ok := false
+
+	err := userdb.withTx(ctx, func(tx *UserDb) error {
+		var stored int64
+
+		err := tx.queryRow(ctx, WEBAUTHN_SIGN_COUNT_SQL, id).Scan(&stored)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !webAuthnSignCountOk(uint32(stored), signCount) {
+			return nil
+		}
+
+		result, err := tx.exec(ctx, USE_WEBAUTHN_CREDENTIAL_SQL, int64(signCount), usedAt, id, stored)
+
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+
+		if err != nil {
+			return err
+		}
+
+		// mysql counts changed rows rather than matched ones, so a
+		// credential without a counter used twice in the same second
+		// reports 0 rows. The row is locked so we know it still
+		// exists with the count we read.
+		ok = n == 1 || signCount == 0
+
+		return nil
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return ok, nil
+}
+
+// The count must go up with each sign in, unless the authenticator
+// does not keep one, in which case it is always 0
+func webAuthnSignCountOk(stored uint32, signCount uint32) bool {
+	return signCount > stored || (signCount == 0 && stored == 0)
+}
+
+func (userdb *UserDb) DeleteWebAuthnCredential(ctx context.Context, user *AuthUser, id string) error {
+	_, err := userdb.exec(ctx, DELETE_WEBAUTHN_CREDENTIAL_SQL, user.Id, id)
+
+	return err
+}
+
+func scanWebAuthnCredential(row rowScanner) (*WebAuthnCredential, error) {
+	var credential WebAuthnCredential
+	var signCount int64
+
+	err := row.Scan(&credential.Id,
+		&credential.UserId,
+		&credential.PublicKey,
+		&signCount,
+		&credential.Name,
+		&credential.CreatedAt,
+		&credential.LastUsedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	credential.SignCount = uint32(signCount)
+
+	return &credential, nil
+}